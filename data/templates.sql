@@ -0,0 +1,29 @@
+-- Example query templates for queryhw, run with: ./queryhw -t data/templates.sql < data/query_params.csv
+-- Each template's params are bound, in order, to the placeholders $1, $2, ... from the named CSV columns.
+-- {{.Bucket}} and {{.Aggregates}} are replaced with each of the values given by -buckets and -aggregates.
+-- A template using them is a Go text/template, any other {{ in its SQL must be escaped like {{"{{"}}.
+
+-- name: cpu_stats
+-- params: hostname, start_time timestamp, end_time timestamp
+SELECT time_bucket('{{.Bucket}}', u.ts) as bucket, {{.Aggregates}}
+FROM cpu_usage u
+WHERE u.host = $1
+AND u.ts BETWEEN $2 AND $3
+GROUP BY bucket
+ORDER BY bucket DESC
+
+-- name: cpu_avg
+-- params: hostname, start_time timestamp, end_time timestamp
+SELECT time_bucket('5 minutes', u.ts) as five_min, avg(u.usage)
+FROM cpu_usage u
+WHERE u.host = $1
+AND u.ts BETWEEN $2 AND $3
+GROUP BY five_min
+ORDER BY five_min DESC
+
+-- name: cpu_last
+-- params: hostname, end_time timestamp
+SELECT last(u.usage, u.ts)
+FROM cpu_usage u
+WHERE u.host = $1
+AND u.ts <= $2
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
 	"runtime/debug"
+	"syscall"
 	"time"
 
 	"github.com/eloff/queryhw/querytool"
@@ -15,8 +20,50 @@ func main() {
 
 	options := querytool.ParseCommandOptions()
 
-	start := time.Now()
-	stats := querytool.Run(&options)
+	// Ctrl-C or SIGTERM stops the benchmark early and prints the summary for the completed queries.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// Restore the default behavior, so a second Ctrl-C kills the program if it's stuck
+		stop()
+	}()
 
-	querytool.PrintSummaryStats(&options, time.Now().Sub(start), stats)
+	var err error
+	if len(options.Sweep) != 0 || options.ConnMode == querytool.BothConns {
+		var levels []querytool.SweepLevel
+		levels, err = querytool.Sweep(ctx, &options)
+		if printErr := querytool.PrintSweep(&options, levels); printErr != nil {
+			if err != nil {
+				// Don't lose the reason the benchmark failed
+				log.Print(err)
+			}
+			log.Fatal(printErr)
+		}
+	} else {
+		var stats *querytool.Results
+		var wallTime time.Duration
+		stats, wallTime, err = querytool.Run(ctx, &options)
+
+		// Explaining the slowest queries isn't part of the wall time, it's for diagnosing them
+		if ctx.Err() == nil {
+			if explainErr := querytool.ExplainSlowest(ctx, &options, stats); explainErr != nil && err == nil {
+				err = explainErr
+			}
+		}
+
+		// Print the stats even if the benchmark was aborted, they're still useful
+		if printErr := querytool.PrintSummaryStats(&options, wallTime, stats); printErr != nil {
+			if err != nil {
+				// Don't lose the reason the benchmark failed
+				log.Print(err)
+			}
+			log.Fatal(printErr)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		log.Fatal("benchmark interrupted")
+	}
 }
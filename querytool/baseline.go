@@ -0,0 +1,324 @@
+package querytool
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Baseline is the result of a previous run, to compare this run with, see LoadBaseline
+type Baseline struct {
+	Path string
+	// Histogram has the durations of the successful queries, excluding the warmup
+	Histogram *Histogram
+	// QPS is the throughput of all the queries, including the failed ones, like Report.ActiveQPS
+	QPS float64
+}
+
+// significanceLevel is the p-value below which the durations are significantly slower than the baseline
+const significanceLevel = 0.05
+
+// LoadBaseline loads a JSON report, written with -format json, or the raw results of a run,
+// written with -raw, as CSV or JSON Lines. Reports from a sweep aren't supported.
+// The JSON report has the histogram of the durations, which is within 0.1% of the values.
+func LoadBaseline(path string) (*Baseline, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadBaseline failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var baseline *Baseline
+	if strings.HasSuffix(path, ".csv") {
+		baseline, err = loadRawCSVBaseline(file)
+	} else {
+		baseline, err = loadJSONBaseline(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("LoadBaseline %s: %w", path, err)
+	}
+	if baseline.Histogram.Count() == 0 {
+		return nil, fmt.Errorf("LoadBaseline %s: no queries succeeded in the baseline", path)
+	}
+	baseline.Path = path
+	return baseline, nil
+}
+
+// loadJSONBaseline reads a JSON report, or raw results as JSON Lines
+func loadJSONBaseline(reader io.Reader) (*Baseline, error) {
+	decoder := json.NewDecoder(bufio.NewReader(reader))
+	raw := newRawBaseline()
+	for line := 1; ; line++ {
+		// The fields of a Report and of a RawRecord, the warmup is an object in a report
+		var record struct {
+			Outcome       string           `json:"outcome"`
+			StartOffsetMs float64          `json:"start_offset_ms"`
+			DurationMs    float64          `json:"duration_ms"`
+			Warmup        json.RawMessage  `json:"warmup"`
+			DelayMs       float64          `json:"delay_ms"`
+			AchievedQPS   float64          `json:"achieved_qps"`
+			ActiveQPS     float64          `json:"active_qps"`
+			Histogram     []HistogramBin   `json:"histogram"`
+			Levels        *json.RawMessage `json:"levels"`
+		}
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return raw.baseline(), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", line, err)
+		}
+
+		if line == 1 && record.Levels != nil {
+			return nil, fmt.Errorf("can't compare with a sweep report")
+		}
+		if line == 1 && record.Histogram != nil {
+			baseline := &Baseline{Histogram: NewHistogram(), QPS: record.ActiveQPS}
+			if baseline.QPS == 0 {
+				// Reports from before the ActiveQPS was added only have the throughput over the wall time
+				baseline.QPS = record.AchievedQPS
+			}
+			for _, bin := range record.Histogram {
+				baseline.Histogram.RecordN(time.Duration(math.Round(bin.Ms*float64(time.Millisecond))), bin.Count)
+			}
+			return baseline, nil
+		}
+		raw.add(record.Outcome, record.StartOffsetMs, record.DurationMs, record.DelayMs, string(record.Warmup) == "true")
+	}
+}
+
+// loadRawCSVBaseline reads raw results as CSV, see RawWriter
+func loadRawCSVBaseline(reader io.Reader) (*Baseline, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.ReuseRecord = true
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %w", err)
+	}
+	columns := map[string]int{"outcome": -1, "start_offset_ms": -1, "duration_ms": -1, "warmup": -1}
+	for i, name := range header {
+		if _, ok := columns[name]; ok {
+			columns[name] = i
+		}
+	}
+	for name, i := range columns {
+		if i < 0 {
+			return nil, fmt.Errorf("the CSV header has no %s column", name)
+		}
+	}
+	// Raw results from before the delay_ms was added have no delay column, it's 0 in the closed-loop mode
+	delayColumn := -1
+	for i, name := range header {
+		if name == "delay_ms" {
+			delayColumn = i
+		}
+	}
+
+	raw := newRawBaseline()
+	for line := 2; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return raw.baseline(), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV: %w", err)
+		}
+		startOffsetMs, err1 := strconv.ParseFloat(record[columns["start_offset_ms"]], 64)
+		durationMs, err2 := strconv.ParseFloat(record[columns["duration_ms"]], 64)
+		warmup, err3 := strconv.ParseBool(record[columns["warmup"]])
+		var delayMs float64
+		var err4 error
+		if delayColumn >= 0 {
+			delayMs, err4 = strconv.ParseFloat(record[delayColumn], 64)
+		}
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			return nil, fmt.Errorf("line %d: invalid start_offset_ms, duration_ms, warmup or delay_ms", line)
+		}
+		raw.add(record[columns["outcome"]], startOffsetMs, durationMs, delayMs, warmup)
+	}
+}
+
+// rawBaseline accumulates the raw results of the measured queries for a Baseline
+type rawBaseline struct {
+	histogram *Histogram
+	queries   int
+	// start and end are the offsets of the first query to start and the last query to complete
+	start, end float64
+}
+
+func newRawBaseline() *rawBaseline {
+	return &rawBaseline{histogram: NewHistogram()}
+}
+
+func (raw *rawBaseline) add(outcome string, startOffsetMs, durationMs, delayMs float64, warmup bool) {
+	if warmup {
+		return
+	}
+	if raw.queries == 0 || startOffsetMs < raw.start {
+		raw.start = startOffsetMs
+	}
+	// The delay is included in the duration, but it was before the start, like Results.LastEnd
+	raw.end = math.Max(raw.end, startOffsetMs+durationMs-delayMs)
+	raw.queries++
+	if outcome == Succeeded.String() {
+		raw.histogram.Record(time.Duration(math.Round(durationMs * float64(time.Millisecond))))
+	}
+}
+
+// baseline returns the Baseline, the throughput is over the time the queries were running, like Results.ActiveQPS
+func (raw *rawBaseline) baseline() *Baseline {
+	baseline := &Baseline{Histogram: raw.histogram}
+	if raw.end > raw.start {
+		baseline.QPS = float64(raw.queries) / (raw.end - raw.start) * 1000
+	}
+	return baseline
+}
+
+// BaselineReport is the part of the Report comparing the run with a Baseline
+type BaselineReport struct {
+	Path string `json:"path"`
+	// ThresholdPercent is how much worse a metric can get before it's a regression
+	ThresholdPercent float64          `json:"threshold_percent"`
+	Metrics          []BaselineMetric `json:"metrics"`
+	// PValue is the p-value of the one-sided Mann-Whitney U test that the durations of the
+	// successful queries are slower than in the baseline, see mannWhitney
+	PValue float64 `json:"p_value"`
+	// SlowerProbability is the probability that a query is slower than a baseline query,
+	// 0.5 if they're the same
+	SlowerProbability float64 `json:"slower_probability"`
+	// Significant is true if the PValue is below the significanceLevel
+	Significant bool `json:"significant"`
+	// Regressed is true if any of the Metrics regressed
+	Regressed bool `json:"regressed"`
+}
+
+// BaselineMetric compares a metric with the Baseline
+type BaselineMetric struct {
+	Name     string  `json:"name"` // median_ms, p95_ms, p99_ms or qps
+	Baseline float64 `json:"baseline"`
+	Current  float64 `json:"current"`
+	// ChangePercent is the change from the baseline, positive if it went up
+	ChangePercent float64 `json:"change_percent"`
+	// Regressed is true if a duration went up by more than the threshold and the durations are
+	// significantly slower, or the throughput went down by more than the threshold
+	Regressed bool `json:"regressed"`
+}
+
+// compareBaseline compares the durations of the successful queries and the throughput with the
+// baseline. The threshold is the change in percent that's a regression, e.g. 10.
+func compareBaseline(baseline *Baseline, histogram *Histogram, qps, threshold float64) *BaselineReport {
+	report := &BaselineReport{Path: baseline.Path, ThresholdPercent: threshold, PValue: 1, SlowerProbability: 0.5}
+	if histogram.Count() != 0 {
+		report.SlowerProbability, report.PValue = mannWhitney(baseline.Histogram, histogram)
+	}
+	report.Significant = report.PValue < significanceLevel
+
+	percentiles := []float64{95, 99}
+	baselineValues := append([]time.Duration{baseline.Histogram.Summary(nil).Median},
+		baseline.Histogram.ValuesAtPercentiles(percentiles)...)
+	var values []time.Duration
+	if histogram.Count() != 0 {
+		values = append([]time.Duration{histogram.Summary(nil).Median}, histogram.ValuesAtPercentiles(percentiles)...)
+	}
+	for i, name := range []string{"median_ms", "p95_ms", "p99_ms"} {
+		metric := BaselineMetric{Name: name, Baseline: millis(baselineValues[i])}
+		if values == nil {
+			// Every query failed, which is as bad as it gets
+			metric.Regressed = true
+		} else {
+			metric.Current = millis(values[i])
+			metric.ChangePercent = changePercent(metric.Baseline, metric.Current)
+			metric.Regressed = report.Significant && metric.ChangePercent > threshold
+		}
+		report.Metrics = append(report.Metrics, metric)
+	}
+
+	if baseline.QPS > 0 {
+		metric := BaselineMetric{Name: "qps", Baseline: baseline.QPS, Current: qps, ChangePercent: changePercent(baseline.QPS, qps)}
+		metric.Regressed = -metric.ChangePercent > threshold
+		report.Metrics = append(report.Metrics, metric)
+	}
+	for _, metric := range report.Metrics {
+		report.Regressed = report.Regressed || metric.Regressed
+	}
+	return report
+}
+
+func changePercent(baseline, current float64) float64 {
+	if baseline == 0 {
+		return 0
+	}
+	return 100 * (current - baseline) / baseline
+}
+
+// mannWhitney runs the one-sided Mann-Whitney U test that the values in current tend to be
+// larger than those in baseline. It returns the probability that a value from current is
+// larger than a value from baseline (counting ties as half), and the p-value from the normal
+// approximation with the tie correction, which is accurate for more than 20 or so values.
+// The test doesn't assume the durations are normally distributed, which they never are.
+// The values are the buckets of the histograms, so values within 0.1% of each other are ties.
+func mannWhitney(baseline, current *Histogram) (float64, float64) {
+	n1 := float64(current.Count())
+	n2 := float64(baseline.Count())
+	baselineBuckets := baseline.Buckets()
+	currentBuckets := current.Buckets()
+
+	// u counts the pairs where the current value is larger, and half of the ties
+	u := 0.0
+	below := 0.0 // the baseline values below the current bucket
+	ties := 0.0  // the sum of t^3 - t for the groups of t equal values
+	i, j := 0, 0
+	for j < len(currentBuckets) || i < len(baselineBuckets) {
+		var b, c float64
+		switch {
+		case j == len(currentBuckets) || (i < len(baselineBuckets) && baselineBuckets[i].Value < currentBuckets[j].Value):
+			b = float64(baselineBuckets[i].Count)
+			i++
+		case i == len(baselineBuckets) || currentBuckets[j].Value < baselineBuckets[i].Value:
+			c = float64(currentBuckets[j].Count)
+			j++
+		default:
+			b = float64(baselineBuckets[i].Count)
+			c = float64(currentBuckets[j].Count)
+			i++
+			j++
+		}
+		u += c * (below + b/2)
+		below += b
+		t := b + c
+		ties += t*t*t - t
+	}
+
+	n := n1 + n2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1)))
+	if variance <= 0 {
+		// All the values are the same
+		return 0.5, 1
+	}
+	// With a continuity correction, since U is discrete
+	z := (u - mean - 0.5) / math.Sqrt(variance)
+	return u / (n1 * n2), 0.5 * math.Erfc(z/math.Sqrt2)
+}
+
+// regressionError returns an error listing the metrics that regressed, if any did
+func (report *BaselineReport) regressionError() error {
+	if report == nil || !report.Regressed {
+		return nil
+	}
+	var regressed []string
+	for _, metric := range report.Metrics {
+		if metric.Regressed {
+			regressed = append(regressed, metric.Name)
+		}
+	}
+	return fmt.Errorf("%s regressed by more than %v%% from the baseline %s",
+		strings.Join(regressed, ", "), report.ThresholdPercent, report.Path)
+}
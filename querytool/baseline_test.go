@@ -0,0 +1,180 @@
+package querytool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func histogramOf(ms ...int) *Histogram {
+	histogram := NewHistogram()
+	for _, value := range ms {
+		histogram.Record(time.Duration(value) * time.Millisecond)
+	}
+	return histogram
+}
+
+func TestMannWhitney(t *testing.T) {
+	tests := []struct {
+		baseline, current *Histogram
+		slower, p         float64
+	}{
+		// Every current value is larger
+		{histogramOf(1, 2, 3, 4, 5), histogramOf(6, 7, 8, 9, 10), 1, 0.0061},
+		{histogramOf(6, 7, 8, 9, 10), histogramOf(1, 2, 3, 4, 5), 0, 0.9967},
+		// Ties count as half
+		{histogramOf(1, 2, 3, 4, 5), histogramOf(1, 2, 3, 4, 5), 0.5, 0.5422},
+		{histogramOf(5, 5, 5), histogramOf(5, 5), 0.5, 1},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		slower, p := mannWhitney(test.baseline, test.current)
+		a.InDelta(slower, test.slower, 1e-9)
+		a.InDelta(p, test.p, 1e-4)
+	}
+}
+
+func TestCompareBaseline(t *testing.T) {
+	baseline := &Baseline{Path: "baseline.json", Histogram: NewHistogram(), QPS: 100}
+	slower := NewHistogram()
+	for i := 1; i <= 100; i++ {
+		baseline.Histogram.Record(time.Duration(i) * time.Millisecond)
+		slower.Record(time.Duration(i+20) * time.Millisecond)
+	}
+
+	a := assert.New(t)
+	report := compareBaseline(baseline, slower, 95, 10)
+	a.True(report.Significant)
+	a.Len(report.Metrics, 4)
+	a.Equal(report.Metrics[0].Name, "median_ms")
+	a.InDelta(report.Metrics[0].ChangePercent, 40, 0.5)
+	a.True(report.Metrics[0].Regressed)
+	// p99 is 99.5ms vs 119.5ms
+	a.InDelta(report.Metrics[2].ChangePercent, 20.1, 0.1)
+	a.True(report.Metrics[2].Regressed)
+	a.Equal(report.Metrics[3], BaselineMetric{Name: "qps", Baseline: 100, Current: 95, ChangePercent: -5})
+	a.True(report.Regressed)
+	a.EqualError(report.regressionError(),
+		"median_ms, p95_ms, p99_ms regressed by more than 10% from the baseline baseline.json")
+
+	// Within the threshold
+	report = compareBaseline(baseline, slower, 40, 50)
+	a.False(report.Metrics[0].Regressed)
+	a.True(report.Metrics[3].Regressed)
+	a.EqualError(report.regressionError(), "qps regressed by more than 50% from the baseline baseline.json")
+
+	// Faster isn't a regression, however much it changed
+	report = compareBaseline(baseline, histogramOf(1, 2, 3), 200, 10)
+	a.False(report.Significant)
+	a.InDelta(report.Metrics[0].ChangePercent, -96, 0.1)
+	a.False(report.Regressed)
+	a.Nil(report.regressionError())
+
+	// Not significant, so the percentiles of a few queries don't count
+	report = compareBaseline(baseline, histogramOf(40, 60, 100), 100, 10)
+	a.False(report.Significant)
+	a.Greater(report.Metrics[0].ChangePercent, 10.0)
+	a.False(report.Regressed)
+
+	report = compareBaseline(baseline, NewHistogram(), 100, 10)
+	a.True(report.Regressed)
+	a.Nil((*BaselineReport)(nil).regressionError())
+}
+
+func TestLoadBaseline(t *testing.T) {
+	a := assert.New(t)
+	dir := t.TempDir()
+
+	var output strings.Builder
+	a.Nil(testReport().Write(&output, JSONFormat))
+	reportPath := filepath.Join(dir, "report.json")
+	a.Nil(os.WriteFile(reportPath, []byte(output.String()), 0644))
+	baseline, err := LoadBaseline(reportPath)
+	a.Nil(err)
+	a.Equal(baseline.Path, reportPath)
+	// The active throughput, 4 queries in 30ms, rather than the achieved_qps over the wall time
+	a.InDelta(baseline.QPS, 400.0/3, 1e-9)
+	a.Equal(baseline.Histogram.Count(), int64(3))
+	a.Equal(baseline.Histogram.Buckets(), histogramOf(10, 20, 30).Buckets())
+
+	// Older reports without the active_qps
+	baseline, err = loadJSONBaseline(strings.NewReader(`{"achieved_qps": 100, "histogram": [{"ms": 10, "count": 2}]}`))
+	a.Nil(err)
+	a.Equal(baseline.QPS, 100.0)
+	a.Equal(baseline.Histogram.Buckets(), histogramOf(10, 10).Buckets())
+
+	// The warmup queries are excluded
+	raw := `query,host,worker,outcome,error_class,error,rows,bytes,start_time,start_offset_ms,duration_ms,first_row_ms,drain_ms,warmup,param_hostname
+cpu_stats,host_1,1,succeeded,,,60,2400,2022-02-01T12:00:00.01Z,10,5,2,0.5,true,host_1
+cpu_stats,host_1,1,succeeded,,,60,2400,2022-02-01T12:00:00.01Z,100,10,2,0.5,false,host_1
+cpu_stats,host_2,2,failed,sql,syntax error,0,0,2022-02-01T12:00:00.02Z,120,30,0,0,false,host_2
+cpu_stats,host_1,1,succeeded,,,60,2400,2022-02-01T12:00:00.01Z,110,40,2,0.5,false,host_1
+`
+	baseline, err = loadRawCSVBaseline(strings.NewReader(raw))
+	a.Nil(err)
+	a.Equal(baseline.Histogram.Buckets(), histogramOf(10, 40).Buckets())
+	// 3 queries from 100ms to 150ms
+	a.InDelta(baseline.QPS, 60, 1e-9)
+
+	jsonl := `{"query":"cpu_stats","outcome":"succeeded","start_offset_ms":0,"duration_ms":20,"warmup":false}
+{"query":"cpu_stats","outcome":"timed_out","start_offset_ms":10,"duration_ms":90,"warmup":false}
+`
+	baseline, err = loadJSONBaseline(strings.NewReader(jsonl))
+	a.Nil(err)
+	a.Equal(baseline.Histogram.Buckets(), histogramOf(20).Buckets())
+	a.InDelta(baseline.QPS, 20, 1e-9)
+
+	sweepPath := filepath.Join(dir, "sweep.json")
+	a.Nil(os.WriteFile(sweepPath, []byte(`{"levels": []}`), 0644))
+	_, err = LoadBaseline(sweepPath)
+	a.EqualError(err, "LoadBaseline "+sweepPath+": can't compare with a sweep report")
+	emptyPath := filepath.Join(dir, "empty.csv")
+	a.Nil(os.WriteFile(emptyPath, []byte("outcome,start_offset_ms,duration_ms,warmup\n"), 0644))
+	_, err = LoadBaseline(emptyPath)
+	a.EqualError(err, "LoadBaseline "+emptyPath+": no queries succeeded in the baseline")
+	_, err = LoadBaseline(filepath.Join(dir, "missing.json"))
+	a.NotNil(err)
+}
+
+func TestCompareWithOwnRawResults(t *testing.T) {
+	a := assert.New(t)
+	path := filepath.Join(t.TempDir(), "raw.csv")
+	start := time.Date(2022, 2, 1, 12, 0, 0, 0, time.UTC)
+	// The run took longer than the queries, e.g. opening the connections
+	writer, err := NewRawWriter(path, nil, start.Add(-time.Second))
+	a.Nil(err)
+
+	results := NewResults()
+	for i := 0; i < 100; i++ {
+		stats := &QueryStats{WorkerId: i%4 + 1, Query: "a", Host: "host_1",
+			Start: start.Add(time.Duration(i) * 5 * time.Millisecond), Duration: time.Duration(i%20+1) * time.Millisecond}
+		// In the open-loop mode the delay before the query started is included in the duration
+		stats.Delay = time.Duration(i%3+1) * time.Millisecond
+		stats.Duration += stats.Delay
+		if i%10 == 0 {
+			stats.Err = &QueryError{Class: SQLError, Err: errors.New("syntax error")}
+		}
+		results.Add(stats)
+		a.Nil(writer.Write(stats))
+	}
+	a.Nil(writer.Close())
+	// The last query started at 495ms and ran for 20ms, after a 1ms delay
+	a.Equal(results.LastEnd, start.Add(515*time.Millisecond))
+
+	baseline, err := LoadBaseline(path)
+	a.Nil(err)
+	results.Baseline = baseline
+	report := NewReport(&Options{NumWorkers: 4, RegressionThreshold: 1}, 2*time.Second, results)
+	a.False(report.Baseline.Regressed)
+	for _, metric := range report.Baseline.Metrics {
+		a.InDelta(metric.ChangePercent, 0, 1e-6, metric.Name)
+	}
+	a.Nil(report.Baseline.regressionError())
+}
@@ -1,33 +1,479 @@
 package querytool
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/lib/pq" // load the Postgres driver
 )
 
-var pool *sql.DB
+// pool is the connection pool of the database driver selected by Options.Driver
+var pool backend
+
+// The supported Options.Protocol
+const (
+	ExtendedProtocol = "extended" // the unnamed extended protocol, the query is parsed and planned every time
+	PreparedProtocol = "prepared" // a named prepared statement for each query on each connection
+	SimpleProtocol   = "simple"   // the simple protocol, with the params inlined as literals
+)
+
+// The supported Options.Driver
+const (
+	PQDriver  = "pq"  // lib/pq through database/sql
+	PGXDriver = "pgx" // the native pgx interface
+)
+
+// queryer runs queries, it's either the pool or a dedicated connection
+type queryer interface {
+	// queryAndDiscard runs the query, fetching and discarding the result rows,
+	// and returns the fetchStats. Cancelling ctx cancels the query on the server.
+	queryAndDiscard(ctx context.Context, query string, args ...interface{}) (fetchStats, error)
+	// queryRows runs the query and returns the result rows, with the values
+	// converted by resultValue, so they can be verified
+	queryRows(ctx context.Context, query string, args ...interface{}) ([][]interface{}, fetchStats, error)
+}
+
+// fetchStats are the stats of fetching the result rows of a query
+type fetchStats struct {
+	rows int
+	// bytes is the approximate size of the result values, as sent by the server.
+	// It doesn't include the protocol overhead, like the row and value lengths.
+	bytes int64
+	// firstRow is when the first row was received, or when the query
+	// completed if there were no rows. Fetching the rest is draining them.
+	firstRow time.Time
+}
+
+// dedicatedConn is a connection taken from the pool, see openConns
+type dedicatedConn interface {
+	queryer
+	ping(ctx context.Context) error
+	// release returns the connection to the pool
+	release()
+}
+
+// backend is the connection pool of a database driver, so the benchmark
+// can measure the overhead of the driver by running the same queries with each.
+type backend interface {
+	queryer
+	// conn takes a connection from the pool until it's released
+	conn(ctx context.Context) (dedicatedConn, error)
+	// stats returns the PoolStats since the pool was opened
+	stats() PoolStats
+	// queryValue runs a query that returns a single value, like EXPLAIN (FORMAT JSON)
+	queryValue(ctx context.Context, query string, args ...interface{}) ([]byte, error)
+}
+
+// PoolConfig are the limits of the connection pool, see the sql.DB methods of the same names.
+// The Go defaults are unlimited open connections and only 2 idle connections, which means
+// connections are closed and reopened during the benchmark when there are more workers.
+type PoolConfig struct {
+	MaxOpenConns    int           // 0 for no limit
+	MaxIdleConns    int           // negative for no idle connections
+	ConnMaxLifetime time.Duration // 0 to reuse connections forever
+	// Protocol is how the connections run queries: extended, prepared or simple.
+	// The simple protocol requires the caller to inline the params, see Query.inlineArgs.
+	Protocol string
+	// NumWorkers is the most workers running queries at once, the size of the pgx pool
+	// if there's no other limit
+	NumWorkers int
+}
+
+// InitDB opens the connection pool using the driver (pq or pgx). If statementTimeout is
+// not zero it's set as the statement_timeout for every connection, so the server also
+// cancels queries that run too long, even if the client went away.
+func InitDB(driver, connectionString string, statementTimeout time.Duration, config PoolConfig) error {
+	if statementTimeout > 0 {
+		var err error
+		connectionString, err = withRuntimeParam(connectionString,
+			"statement_timeout", fmt.Sprint(statementTimeout.Milliseconds()))
+		if err != nil {
+			return err
+		}
+	}
 
-func InitDB(connectionString string) error {
 	var err error
-	pool, err = sql.Open("postgres", connectionString)
+	switch config.Protocol {
+	case ExtendedProtocol, PreparedProtocol, SimpleProtocol, "":
+	default:
+		return fmt.Errorf("unknown protocol %s", config.Protocol)
+	}
+
+	switch driver {
+	case PGXDriver:
+		pool, err = openPGXPool(connectionString, config)
+	case PQDriver, "":
+		pool, err = openSQLPool("postgres", connectionString, config)
+	default:
+		err = fmt.Errorf("unknown driver %s", driver)
+	}
 	return err
 }
 
-// executeQueryAndDiscardResults runs the query and returns the number of result rows and any error
+// openConns takes n dedicated connections from the pool, see Options.ConnMode.
+// The caller must close them when finished, which returns them to the pool.
+func openConns(ctx context.Context, n int) ([]dedicatedConn, error) {
+	conns := make([]dedicatedConn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := pool.conn(ctx)
+		if err == nil {
+			conns = append(conns, conn)
+			err = conn.ping(ctx)
+		}
+		if err != nil {
+			closeConns(conns)
+			return nil, fmt.Errorf("failed to open connection %d: %w", i+1, err)
+		}
+	}
+	return conns, nil
+}
+
+// closeConns closes the connections, returning them to the pool
+func closeConns(conns []dedicatedConn) {
+	for _, conn := range conns {
+		conn.release()
+	}
+}
+
+// PrewarmPool opens n connections, so the first queries don't have to wait for them.
+// They're returned to the pool as idle connections, so n should be no more
+// than the PoolConfig.MaxIdleConns, otherwise the extra connections are closed.
+// It opens no more connections than the pool allows, see prewarmLimit.
+func PrewarmPool(ctx context.Context, n int) error {
+	n = prewarmLimit(n, pool.stats().MaxOpenConnections)
+	// The connections must all be open at the same time, otherwise the pool would reuse the first one
+	conns, err := openConns(ctx, n)
+	if err != nil {
+		return fmt.Errorf("PrewarmPool: %w", err)
+	}
+	closeConns(conns)
+	return nil
+}
+
+// prewarmLimit returns n, or maxOpen if that's lower, otherwise waiting for more connections than
+// the pool allows would never finish. The pgx pool is always limited, see pgxDefaultMaxConns.
+// A maxOpen of 0 is unlimited.
+func prewarmLimit(n, maxOpen int) int {
+	if maxOpen > 0 && n > maxOpen {
+		return maxOpen
+	}
+	return n
+}
+
+// PoolStats are the connection pool stats for a period of the benchmark
+type PoolStats struct {
+	MaxOpenConnections int
+	OpenConnections    int // at the end of the period
+	// WaitCount is the number of times a query waited for a connection because
+	// of MaxOpenConns, and WaitDuration is the total time waited. This time
+	// is included in the query durations.
+	WaitCount         int64
+	WaitDuration      time.Duration
+	MaxIdleClosed     int64 // connections closed because of MaxIdleConns
+	MaxLifetimeClosed int64 // connections closed because of ConnMaxLifetime
+}
+
+// poolStatsSince returns the PoolStats for the period since the start stats were taken
+func poolStatsSince(start PoolStats) *PoolStats {
+	end := pool.stats()
+	return &PoolStats{
+		MaxOpenConnections: end.MaxOpenConnections,
+		OpenConnections:    end.OpenConnections,
+		WaitCount:          end.WaitCount - start.WaitCount,
+		WaitDuration:       end.WaitDuration - start.WaitDuration,
+		MaxIdleClosed:      end.MaxIdleClosed - start.MaxIdleClosed,
+		MaxLifetimeClosed:  end.MaxLifetimeClosed - start.MaxLifetimeClosed,
+	}
+}
+
+// withRuntimeParam adds a run-time parameter to the connection string.
+// lib/pq sends connection string parameters it doesn't recognize to the server
+// at startup, which sets them for the session, like SET name = value.
+// The connection string can be a URL or a list of key=value pairs.
+func withRuntimeParam(connectionString, name, value string) (string, error) {
+	if strings.HasPrefix(connectionString, "postgres://") || strings.HasPrefix(connectionString, "postgresql://") {
+		u, err := url.Parse(connectionString)
+		if err != nil {
+			return "", fmt.Errorf("invalid connection string: %w", err)
+		}
+		query := u.Query()
+		query.Set(name, value)
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	// Values in the key=value format are quoted with single quotes, escaping \ and '
+	value = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+	return fmt.Sprintf("%s %s='%s'", connectionString, name, value), nil
+}
+
+// executeQueryAndDiscardResults runs the query on db and returns the fetchStats and any error
 // This function fetches and discards the result rows.
-func executeQueryAndDiscardResults(query string, args ...interface{}) (int, error) {
-	rows, err := pool.Query(query, args...)
+// Cancelling ctx cancels the query on the server.
+func executeQueryAndDiscardResults(ctx context.Context, db queryer, query string, args ...interface{}) (fetchStats, error) {
+	return db.queryAndDiscard(ctx, query, args...)
+}
+
+// sqlPool is the backend for database/sql drivers, like lib/pq.
+// lib/pq uses the unnamed extended protocol for queries with params
+// and the simple protocol for queries without them.
+type sqlPool struct {
+	db *sql.DB
+	// statements has the prepared statements if the protocol is prepared.
+	// A sql.Stmt prepares itself on each connection it's used on.
+	statements *statementCache
+}
+
+// statementCache prepares a statement for each query the first time it's used
+type statementCache struct {
+	prepare func(ctx context.Context, query string) (*sql.Stmt, error)
+	// mutex is nil if the cache is only used by one goroutine
+	mutex      *sync.Mutex
+	statements map[string]*sql.Stmt
+}
+
+func newStatementCache(prepare func(ctx context.Context, query string) (*sql.Stmt, error), shared bool) *statementCache {
+	cache := &statementCache{prepare: prepare, statements: make(map[string]*sql.Stmt)}
+	if shared {
+		cache.mutex = &sync.Mutex{}
+	}
+	return cache
+}
+
+// get returns the prepared statement for the query
+func (cache *statementCache) get(ctx context.Context, query string) (*sql.Stmt, error) {
+	if cache.mutex != nil {
+		cache.mutex.Lock()
+		defer cache.mutex.Unlock()
+	}
+	if stmt := cache.statements[query]; stmt != nil {
+		return stmt, nil
+	}
+	stmt, err := cache.prepare(ctx, query)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	cache.statements[query] = stmt
+	return stmt, nil
+}
+
+// close closes the prepared statements
+func (cache *statementCache) close() {
+	for _, stmt := range cache.statements {
+		stmt.Close()
+	}
+}
+
+// queryAndDiscard runs the query as a prepared statement
+func (cache *statementCache) queryAndDiscard(ctx context.Context, query string, args ...interface{}) (fetchStats, error) {
+	stmt, err := cache.get(ctx, query)
+	if err != nil {
+		return fetchStats{}, err
+	}
+	return discardRows(stmt.QueryContext(ctx, args...))
+}
+
+// queryRows runs the query as a prepared statement
+func (cache *statementCache) queryRows(ctx context.Context, query string, args ...interface{}) ([][]interface{}, fetchStats, error) {
+	stmt, err := cache.get(ctx, query)
+	if err != nil {
+		return nil, fetchStats{}, err
+	}
+	return scanRows(stmt.QueryContext(ctx, args...))
+}
+
+func openSQLPool(driverName, connectionString string, config PoolConfig) (*sqlPool, error) {
+	db, err := sql.Open(driverName, connectionString)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+
+	p := &sqlPool{db: db}
+	if config.Protocol == PreparedProtocol {
+		p.statements = newStatementCache(db.PrepareContext, true)
+	}
+	return p, nil
+}
+
+func (p *sqlPool) queryAndDiscard(ctx context.Context, query string, args ...interface{}) (fetchStats, error) {
+	if p.statements != nil {
+		return p.statements.queryAndDiscard(ctx, query, args...)
+	}
+	return discardRows(p.db.QueryContext(ctx, query, args...))
+}
+
+func (p *sqlPool) queryRows(ctx context.Context, query string, args ...interface{}) ([][]interface{}, fetchStats, error) {
+	if p.statements != nil {
+		return p.statements.queryRows(ctx, query, args...)
+	}
+	return scanRows(p.db.QueryContext(ctx, query, args...))
+}
+
+func (p *sqlPool) queryValue(ctx context.Context, query string, args ...interface{}) ([]byte, error) {
+	// This isn't part of the benchmark, so it doesn't use the prepared statements
+	var value []byte
+	err := p.db.QueryRowContext(ctx, query, args...).Scan(&value)
+	return value, err
+}
+
+func (p *sqlPool) conn(ctx context.Context) (dedicatedConn, error) {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := sqlConn{conn: conn}
+	if p.statements != nil {
+		// The connection is only used by one worker
+		c.statements = newStatementCache(conn.PrepareContext, false)
+	}
+	return c, nil
+}
+
+func (p *sqlPool) stats() PoolStats {
+	stats := p.db.Stats()
+	return PoolStats{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		WaitCount:          stats.WaitCount,
+		WaitDuration:       stats.WaitDuration,
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
+
+// sqlConn is a dedicated database/sql connection
+type sqlConn struct {
+	conn       *sql.Conn
+	statements *statementCache // the prepared statements on this connection, if the protocol is prepared
+}
+
+func (c sqlConn) queryAndDiscard(ctx context.Context, query string, args ...interface{}) (fetchStats, error) {
+	if c.statements != nil {
+		return c.statements.queryAndDiscard(ctx, query, args...)
+	}
+	return discardRows(c.conn.QueryContext(ctx, query, args...))
+}
+
+func (c sqlConn) queryRows(ctx context.Context, query string, args ...interface{}) ([][]interface{}, fetchStats, error) {
+	if c.statements != nil {
+		return c.statements.queryRows(ctx, query, args...)
+	}
+	return scanRows(c.conn.QueryContext(ctx, query, args...))
+}
+
+func (c sqlConn) ping(ctx context.Context) error {
+	return c.conn.PingContext(ctx)
+}
+
+func (c sqlConn) release() {
+	if c.statements != nil {
+		c.statements.close()
+	}
+	c.conn.Close()
+}
+
+// discardRows fetches and discards the rows, returning the fetchStats
+func discardRows(rows *sql.Rows, err error) (fetchStats, error) {
+	var stats fetchStats
+	if err != nil {
+		return stats, err
 	}
 	defer rows.Close()
 
-	numRows := 0
+	// Scanning into RawBytes doesn't copy or convert the values,
+	// they're the text (or binary) values sent by the server
+	columns, err := rows.Columns()
+	if err != nil {
+		return stats, err
+	}
+	values := make([]sql.RawBytes, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
 	for rows.Next() {
+		if stats.rows == 0 {
+			stats.firstRow = time.Now()
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return stats, err
+		}
 		// Discard the result rows
-		numRows++
+		stats.rows++
+		for _, value := range values {
+			stats.bytes += int64(len(value))
+		}
+	}
+	if stats.rows == 0 {
+		stats.firstRow = time.Now()
+	}
+
+	return stats, rows.Err()
+}
+
+// scanRows fetches the rows, returning their values converted by resultValue.
+// The bytes in the fetchStats are estimated from the values, see valueSize.
+func scanRows(rows *sql.Rows, err error) ([][]interface{}, fetchStats, error) {
+	var stats fetchStats
+	if err != nil {
+		return nil, stats, err
 	}
+	defer rows.Close()
 
-	return numRows, rows.Err()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, stats, err
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	var result [][]interface{}
+	for rows.Next() {
+		if stats.rows == 0 {
+			stats.firstRow = time.Now()
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, stats, err
+		}
+		stats.rows++
+		row := make([]interface{}, len(values))
+		for i, value := range values {
+			stats.bytes += valueSize(value)
+			row[i] = resultValue(value)
+		}
+		result = append(result, row)
+	}
+	if stats.rows == 0 {
+		stats.firstRow = time.Now()
+	}
+	return result, stats, rows.Err()
+}
+
+// valueSize estimates the size of a value returned by the database driver, as sent by the server
+func valueSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	case bool:
+		return 1
+	default:
+		// Timestamps and most numbers are 8 bytes in the binary format
+		return 8
+	}
 }
@@ -0,0 +1,126 @@
+package querytool
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+)
+
+// ErrorClass is the kind of failure of a query, errors are counted by class in the summary
+type ErrorClass int
+
+const (
+	OtherError ErrorClass = iota
+	TimeoutError
+	ConnectionError
+	SQLError
+)
+
+// errorClasses lists the classes of failed queries in the order they're reported.
+// Timeouts are reported separately, see QueryStats.Outcome.
+var errorClasses = []ErrorClass{ConnectionError, SQLError, OtherError}
+
+func (class ErrorClass) String() string {
+	switch class {
+	case TimeoutError:
+		return "timeout"
+	case ConnectionError:
+		return "connection"
+	case SQLError:
+		return "sql"
+	default:
+		return "other"
+	}
+}
+
+// QueryError is the error from a failed query, it's sent back
+// to the main goroutine in QueryStats.Err
+type QueryError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (err *QueryError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *QueryError) Unwrap() error {
+	return err.Err
+}
+
+// newQueryError wraps err in a QueryError with its ErrorClass.
+// The timeout is the query timeout, which is also the statement_timeout, see InitDB.
+// Without one, a cancelled query wasn't a timeout, e.g. it was cancelled by
+// pg_cancel_backend, so it's a SQLError rather than a timeout after 0ms.
+func newQueryError(err error, timeout time.Duration) *QueryError {
+	class := classifyError(err)
+	if code, ok := sqlState(err); ok && code == queryCanceled && timeout == 0 {
+		class = SQLError
+	}
+	return &QueryError{Class: class, Err: err}
+}
+
+func classifyError(err error) ErrorClass {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return TimeoutError
+	}
+	if code, ok := sqlState(err); ok {
+		return classifySQLState(code)
+	}
+	if pgconn.Timeout(err) {
+		return TimeoutError
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return TimeoutError
+		}
+		return ConnectionError
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ConnectionError
+	}
+
+	return OtherError
+}
+
+// sqlState returns the SQLSTATE code of an error reported by the server,
+// lib/pq and pgx have their own types for them
+func sqlState(err error) (string, bool) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code), true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code, true
+	}
+	return "", false
+}
+
+// queryCanceled is the SQLSTATE code of a cancelled query, this is also how statement_timeout is reported
+const queryCanceled = "57014"
+
+// classifySQLState returns the ErrorClass of an error reported by the server with the SQLSTATE code
+func classifySQLState(code string) ErrorClass {
+	switch {
+	case code == queryCanceled:
+		return TimeoutError
+	case strings.HasPrefix(code, "08"), // connection_exception
+		code == "53300", // too_many_connections
+		code == "57P01": // admin_shutdown
+		return ConnectionError
+	default:
+		return SQLError
+	}
+}
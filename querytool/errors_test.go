@@ -0,0 +1,88 @@
+package querytool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err   error
+		class ErrorClass
+	}{
+		{
+			err:   context.DeadlineExceeded,
+			class: TimeoutError,
+		},
+		{
+			err:   &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"},
+			class: TimeoutError,
+		},
+		{
+			err: &net.OpError{
+				Op:  "dial",
+				Net: "tcp",
+				Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+			},
+			class: ConnectionError,
+		},
+		{
+			err:   &pq.Error{Code: "08006", Message: "connection failure"},
+			class: ConnectionError,
+		},
+		{
+			err:   &pq.Error{Code: "42P01", Message: `relation "cpu_usag" does not exist`},
+			class: SQLError,
+		},
+		// pgx errors have the same codes
+		{
+			err:   &pgconn.PgError{Code: "57014", Message: "canceling statement due to statement timeout"},
+			class: TimeoutError,
+		},
+		{
+			err:   &pgconn.PgError{Code: "57P01", Message: "terminating connection due to administrator command"},
+			class: ConnectionError,
+		},
+		{
+			err:   &pgconn.PgError{Code: "42P01", Message: `relation "cpu_usag" does not exist`},
+			class: SQLError,
+		},
+		// Wrapped errors are unwrapped
+		{
+			err:   fmt.Errorf("running query: %w", &pq.Error{Code: "42601", Message: "syntax error"}),
+			class: SQLError,
+		},
+		{
+			err:   errors.New("something else"),
+			class: OtherError,
+		},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		a.Equal(classifyError(test.err), test.class)
+	}
+}
+
+func TestNewQueryError(t *testing.T) {
+	a := assert.New(t)
+	canceled := &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}
+	a.Equal(newQueryError(canceled, time.Second).Class, TimeoutError)
+	// Without a statement_timeout the query was cancelled some other way
+	canceled = &pq.Error{Code: "57014", Message: "canceling statement due to user request"}
+	a.Equal(newQueryError(canceled, 0).Class, SQLError)
+	a.Equal(newQueryError(&pgconn.PgError{Code: "57014"}, 0).Class, SQLError)
+	a.Equal(newQueryError(context.DeadlineExceeded, 0).Class, TimeoutError)
+	a.Equal(newQueryError(&pq.Error{Code: "42601"}, time.Second).Class, SQLError)
+}
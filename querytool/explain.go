@@ -0,0 +1,142 @@
+package querytool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// ExplainedQuery is one of the slowest queries of the benchmark,
+// run again with EXPLAIN ANALYZE to find out why it was slow
+type ExplainedQuery struct {
+	Query  string                 `json:"query"`
+	Host   string                 `json:"host"`
+	Params map[string]interface{} `json:"params"`
+	// DurationMs is how long the query took in the benchmark
+	DurationMs float64 `json:"duration_ms"`
+	// ExecutionMs and PlanningMs are the times in the plan, when it was run again
+	ExecutionMs float64 `json:"execution_ms"`
+	PlanningMs  float64 `json:"planning_ms"`
+	// Chunks is the number of TimescaleDB chunks scanned. The query only needs the chunks
+	// for its time range, if it scans more than that the chunk exclusion isn't working.
+	Chunks           int   `json:"chunks"`
+	SharedHitBlocks  int64 `json:"shared_hit_blocks"`
+	SharedReadBlocks int64 `json:"shared_read_blocks"`
+	// Error is why the query couldn't be explained, the rest is empty if it's set
+	Error string `json:"error,omitempty"`
+	// Plan is the output of EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON)
+	Plan json.RawMessage `json:"plan,omitempty"`
+}
+
+// ExplainSlowest runs the slowest queries kept in the results (see Results.KeepSlowest)
+// again with EXPLAIN ANALYZE, stores them in results.Explained and writes them,
+// with their plans, as a JSON array to Options.ExplainFilePath.
+// Running the query again warms the cache, so the plan may be faster than the benchmark was,
+// compare the shared read blocks (from the disk or the OS cache) with the hit blocks.
+func ExplainSlowest(ctx context.Context, options *Options, results *Results) error {
+	slowest := results.Slowest()
+	if len(slowest) == 0 {
+		return nil
+	}
+	if options.Verbose {
+		fmt.Fprintf(os.Stderr, "running the %d slowest queries again with EXPLAIN ANALYZE\n", len(slowest))
+	}
+
+	results.Explained = make([]ExplainedQuery, 0, len(slowest))
+	for _, stats := range slowest {
+		if ctx.Err() != nil {
+			break
+		}
+		results.Explained = append(results.Explained, explainQuery(ctx, stats.query, millis(stats.Duration)))
+	}
+
+	file, err := os.Create(options.ExplainFilePath)
+	if err != nil {
+		return fmt.Errorf("ExplainSlowest failed to create %s: %w", options.ExplainFilePath, err)
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(results.Explained); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// explainQuery runs the query with EXPLAIN ANALYZE the same way it was run in the benchmark
+func explainQuery(ctx context.Context, query *Query, durationMs float64) ExplainedQuery {
+	explained := ExplainedQuery{
+		Query:      query.Template.Name,
+		Host:       query.Host,
+		Params:     formatParams(query.Template, query.Args),
+		DurationMs: durationMs,
+	}
+
+	const explain = "EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) "
+	var plan []byte
+	var err error
+	if query.inlinedSQL != "" {
+		plan, err = pool.queryValue(ctx, explain+query.inlinedSQL)
+	} else {
+		plan, err = pool.queryValue(ctx, explain+query.Template.SQL, query.Args...)
+	}
+	if err == nil {
+		err = explained.parsePlan(plan)
+	}
+	if err != nil {
+		explained.Error = err.Error()
+	}
+	return explained
+}
+
+// planNode is the part of a node of the JSON plan that we look at
+type planNode struct {
+	RelationName     string     `json:"Relation Name"`
+	SharedHitBlocks  int64      `json:"Shared Hit Blocks"`
+	SharedReadBlocks int64      `json:"Shared Read Blocks"`
+	Plans            []planNode `json:"Plans"`
+}
+
+// chunkPattern matches the names of the TimescaleDB chunk tables, but not
+// the compressed chunks, which are scanned for the chunk they belong to
+var chunkPattern = regexp.MustCompile(`^_hyper_\d+_\d+_chunk$`)
+
+// parsePlan sets the Plan and the stats from it
+func (explained *ExplainedQuery) parsePlan(plan []byte) error {
+	// EXPLAIN returns an array with one plan for the query
+	var statements []struct {
+		Plan          planNode `json:"Plan"`
+		PlanningTime  float64  `json:"Planning Time"`
+		ExecutionTime float64  `json:"Execution Time"`
+	}
+	if err := json.Unmarshal(plan, &statements); err != nil {
+		return fmt.Errorf("failed to parse the plan: %w", err)
+	}
+	if len(statements) != 1 {
+		return fmt.Errorf("expected a plan for 1 statement, got %d", len(statements))
+	}
+	statement := statements[0]
+
+	explained.Plan = plan
+	explained.PlanningMs = statement.PlanningTime
+	explained.ExecutionMs = statement.ExecutionTime
+	// The buffers of a node include those of its children
+	explained.SharedHitBlocks = statement.Plan.SharedHitBlocks
+	explained.SharedReadBlocks = statement.Plan.SharedReadBlocks
+	chunks := make(map[string]bool)
+	statement.Plan.findChunks(chunks)
+	explained.Chunks = len(chunks)
+	return nil
+}
+
+// findChunks adds the chunks scanned by the node and its children
+func (node *planNode) findChunks(chunks map[string]bool) {
+	if chunkPattern.MatchString(node.RelationName) {
+		chunks[node.RelationName] = true
+	}
+	for i := range node.Plans {
+		node.Plans[i].findChunks(chunks)
+	}
+}
@@ -0,0 +1,42 @@
+package querytool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A plan like the cpu_stats query makes, which scans 2 chunks, one of them compressed, and a chunk twice
+const testPlan = `[{
+  "Plan": {
+    "Node Type": "Sort", "Shared Hit Blocks": 120, "Shared Read Blocks": 8,
+    "Plans": [{
+      "Node Type": "Append",
+      "Plans": [
+        {"Node Type": "Index Scan", "Relation Name": "_hyper_1_1_chunk"},
+        {"Node Type": "Custom Scan", "Custom Plan Provider": "DecompressChunk", "Relation Name": "_hyper_1_2_chunk",
+          "Plans": [{"Node Type": "Seq Scan", "Relation Name": "compress_hyper_2_3_chunk"}]},
+        {"Node Type": "Index Scan", "Relation Name": "_hyper_1_1_chunk"},
+        {"Node Type": "Seq Scan", "Relation Name": "cpu_usage"}
+      ]
+    }]
+  },
+  "Planning Time": 1.5,
+  "Execution Time": 12.25
+}]`
+
+func TestParsePlan(t *testing.T) {
+	a := assert.New(t)
+	var explained ExplainedQuery
+	a.Nil(explained.parsePlan([]byte(testPlan)))
+	a.Equal(explained.Chunks, 2)
+	a.Equal(explained.PlanningMs, 1.5)
+	a.Equal(explained.ExecutionMs, 12.25)
+	a.Equal(explained.SharedHitBlocks, int64(120))
+	a.Equal(explained.SharedReadBlocks, int64(8))
+	a.Equal(string(explained.Plan), testPlan)
+
+	explained = ExplainedQuery{}
+	a.EqualError(explained.parsePlan([]byte(`[]`)), "expected a plan for 1 statement, got 0")
+	a.Nil(explained.Plan)
+}
@@ -2,16 +2,116 @@ package querytool
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Options struct {
 	DBConnectionString string
 	InputFilePath      string
+	TemplatesFilePath  string
+	QueryNames         []string
+	Buckets            []string
+	Aggregates         []string
 	NumWorkers         int
 	Verbose            bool
+	// MaxErrors is the number of failed queries after which the benchmark is aborted.
+	// 1 aborts on the first error, 0 keeps going regardless of errors.
+	MaxErrors int
+	// QueryTimeout is the maximum time a query can run before it's cancelled, 0 for no limit
+	QueryTimeout time.Duration
+	// OutputFormat is the format of the summary report: text, json or csv
+	OutputFormat string
+	// OutputFilePath is where the summary report is written, "-" or empty for STDOUT
+	OutputFilePath string
+	// RawFilePath is where the stats for every query are written as they complete, if not empty
+	RawFilePath string
+	// Percentiles are the percentiles of the query durations to report, in the range (0, 100)
+	Percentiles []float64
+	// PrintHistogram includes the latency distribution in the text report
+	PrintHistogram bool
+	// Iterations is the number of passes over the input queries, 0 to loop until Duration is up
+	Iterations int
+	// Duration stops the benchmark after this long, 0 for no limit
+	Duration time.Duration
+	// Rate is the target queries per second in the open-loop mode, 0 for the closed-loop
+	// mode where each worker runs the next query as soon as the previous one completes.
+	Rate float64
+	// Arrivals is how the open-loop queries are spaced: constant or poisson
+	Arrivals string
+	// WarmupQueries and WarmupDuration are the warmup phase at the start of the benchmark,
+	// the queries completed or started during it are excluded from the stats.
+	// When both are set, the warmup lasts until both are done.
+	WarmupQueries  int
+	WarmupDuration time.Duration
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime configure the connection pool, see PoolConfig.
+	// MaxIdleConns of 0 means the number of workers.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// PrewarmConns is the number of connections to open before the benchmark starts
+	PrewarmConns int
+	// ConnMode is whether the workers share the connection pool or each have their own
+	// connection: pool, dedicated or both to run the benchmark in each mode and compare them.
+	ConnMode string
+	// Driver is the database driver: pq (lib/pq through database/sql) or pgx
+	Driver string
+	// Protocol is how the queries are run: extended, prepared or simple, see PoolConfig
+	Protocol string
+	// Sweep is a list of numbers of workers to run the benchmark with, one after the other,
+	// instead of running it once with NumWorkers. See the Sweep function, which is also
+	// used to compare the ConnMode's.
+	Sweep []int
+	// VerifyFilePath is a golden file of the expected results of the queries, see GoldenRecord
+	VerifyFilePath string
+	// VerifyReferencePath is the cpu_usage CSV file to compute the expected results from, see Verifier
+	VerifyReferencePath string
+	// SaveGoldenPath is where the results of the queries are saved, as a golden file for VerifyFilePath
+	SaveGoldenPath string
+	// Breakdown includes the stats for each host and each worker in the report
+	Breakdown bool
+	// TopHosts is the number of the slowest hosts listed in the breakdown
+	TopHosts int
+	// Progress shows the progress of the benchmark as it runs, unless Verbose is set, see progress
+	Progress bool
+	// Interval is the length of the intervals the run is split into, to report how the
+	// throughput and latency changed during the run, 0 for no intervals. See IntervalStats.
+	Interval time.Duration
+	// IntervalFilePath is where the stats of each interval are written, as CSV
+	IntervalFilePath string
+	// MetricsAddr is the address to serve Prometheus metrics on during the run, e.g. :9100,
+	// empty for none. See Metrics.
+	MetricsAddr string
+	// BaselinePath is a JSON report or raw results of a previous run to compare with, see LoadBaseline
+	BaselinePath string
+	// RegressionThreshold is how much worse, in percent, the latency or throughput can be
+	// than the baseline before the run fails, see BaselineMetric
+	RegressionThreshold float64
+	// ExplainSlowest is the number of the slowest queries to run again with EXPLAIN ANALYZE
+	// after the benchmark, see the ExplainSlowest function
+	ExplainSlowest int
+	// ExplainFilePath is where the plans of the slowest queries are written, as JSON
+	ExplainFilePath string
 }
 
+// The supported Options.ConnMode
+const (
+	PoolConns      = "pool"
+	DedicatedConns = "dedicated"
+	BothConns      = "both"
+)
+
+// The supported Options.Arrivals
+const (
+	ConstantArrivals = "constant"
+	PoissonArrivals  = "poisson"
+)
+
 // This is not a good idea in a real app
 // The credentials will be stored in the binary
 // where anyone can read them.
@@ -24,16 +124,282 @@ func ParseCommandOptions() Options {
 	// Define the command line flags that we accept, and their default values
 	numWorkers := flag.Int("n", runtime.GOMAXPROCS(0), "the number of concurrent workers to run")
 	queriesFile := flag.String("f", "-", "the path to a CSV file containing the queries to run")
+	templatesFile := flag.String("t", "", "the path to a file of named SQL query templates (default the built-in cpu_stats query)")
+	queryNames := flag.String("q", "", "comma separated names of the query templates to run (default all of them)")
+	buckets := flag.String("buckets", defaultBucket,
+		"comma separated time_bucket widths to run each query with, e.g. '10 seconds,1 minute,1 hour'")
+	aggregates := flag.String("aggregates", defaultAggregates,
+		"semicolon separated sets of aggregates to run each query with, e.g. 'min(u.usage), max(u.usage);avg(u.usage)'")
+	maxErrors := flag.Int("max-errors", 1, "abort the benchmark after this many failed queries, 0 to keep going regardless")
+	queryTimeout := flag.Duration("timeout", 0, "cancel queries that take longer than this, e.g. 5s (default no timeout)")
+	outputFormat := flag.String("format", TextFormat, "the format of the summary report: text, json or csv")
+	outputFile := flag.String("o", "-", "the path to write the summary report to (default \"-\" STDOUT)")
+	rawFile := flag.String("raw", "",
+		"the path to write the results of every query to, as CSV, or JSON Lines if the path ends in .jsonl")
+	percentiles := flag.String("p", "95,99", "comma separated percentiles of the query durations to report, e.g. 90,99,99.9")
+	printHistogram := flag.Bool("histogram", false, "include the latency distribution in the text report")
+	breakdown := flag.Bool("breakdown", false, "include the stats for each host and each worker in the report")
+	topHosts := flag.Int("top-hosts", 10, "the number of the slowest hosts (by median) to list with -breakdown")
+	iterations := flag.Int("iterations", 0,
+		"the number of passes over the input queries (default 1, or as many as fit in -duration)")
+	duration := flag.Duration("duration", 0,
+		"run the benchmark for this long, e.g. 10m, looping over the input queries (default one pass)")
+	rate := flag.Float64("rate", 0,
+		"send queries at this many per second regardless of how long they take (default 0, as fast as the workers can)")
+	arrivals := flag.String("arrivals", ConstantArrivals,
+		"how the queries are spaced with -rate: constant or poisson (random, like independent users)")
+	warmupDuration := flag.Duration("warmup", 0,
+		"exclude the queries started in this long at the beginning from the stats, e.g. 30s (default no warmup)")
+	warmupQueries := flag.Int("warmup-queries", 0,
+		"exclude this many queries at the beginning from the stats (default no warmup)")
+	sweep := flag.String("sweep", "",
+		"run the benchmark with each of these numbers of workers and report the scalability, e.g. 1,2,4,8 or 1-16")
+	maxOpenConns := flag.Int("max-open-conns", 0,
+		"the maximum number of open database connections, queries wait for a free one (default 0, no limit)")
+	maxIdleConns := flag.Int("max-idle-conns", 0,
+		"the maximum number of idle database connections kept open, -1 for none (default the number of workers)")
+	connMaxLifetime := flag.Duration("conn-max-lifetime", 0,
+		"close and reopen database connections after this long, e.g. 1m (default reuse them forever)")
+	driver := flag.String("driver", PQDriver, "the database driver: pq (lib/pq through database/sql) or pgx (native)")
+	protocol := flag.String("protocol", ExtendedProtocol,
+		"how the queries are run: extended (parsed and planned every time), prepared (a prepared statement\n"+
+			"for each query on each connection) or simple (the simple protocol with the params inlined)")
+	connMode := flag.String("conn-mode", PoolConns,
+		"pool to share the database connections between the workers, dedicated for a connection per worker,\n"+
+			"or both to run the benchmark in each mode and compare them")
+	verifyFile := flag.String("verify", "",
+		"check the results of the queries against a golden file saved by -save-golden, and report mismatches")
+	verifyReference := flag.String("verify-reference", "",
+		"check the results of the cpu_stats queries against the results computed from this cpu_usage CSV file")
+	saveGolden := flag.String("save-golden", "", "save the results of the queries to this golden file for -verify")
+	showProgress := flag.Bool("progress", true,
+		"show the progress of the benchmark, in place on a terminal or as a line every 10s otherwise (unless -v)")
+	interval := flag.Duration("interval", 0,
+		"print the throughput and latency of every interval of this length during the run, e.g. 10s")
+	intervalFile := flag.String("interval-file", "",
+		"the path to write the stats of each interval to, as CSV (default next to the -o report, or intervals.csv)")
+	metricsAddr := flag.String("metrics-addr", "",
+		"serve Prometheus metrics of the benchmark at /metrics on this address during the run, e.g. :9100")
+	baseline := flag.String("baseline", "",
+		"compare the run with a JSON report (-format json) or raw results (-raw) of a previous run")
+	regressionThreshold := flag.Float64("regression-threshold", 10,
+		"fail if the median, p95 or p99 are significantly slower, or the throughput lower, than the -baseline by this many percent")
+	explainSlowest := flag.Int("explain", 0,
+		"run the N slowest queries again with EXPLAIN ANALYZE after the benchmark and save their plans")
+	explainFile := flag.String("explain-file", "",
+		"the path to write the plans of the slowest queries to (default next to the -o report, or explain.json)")
+	prewarmConns := flag.Int("prewarm", 0, "open this many database connections before the benchmark starts")
 	verbose := flag.Bool("v", false, "print more verbose output as the program runs")
-	dbConnString := flag.String("d", dbConnectionStr, "database connection string for timescaledb, see docs for lib/pq")
+	dbConnString := flag.String("d", dbConnectionStr, "database connection string for timescaledb, see docs for lib/pq or pgx")
 
 	flag.Parse()
 
 	// Copy the values into the Options struct and do any validation here
 	options.NumWorkers = *numWorkers
 	options.InputFilePath = *queriesFile
+	options.TemplatesFilePath = *templatesFile
+	options.QueryNames = splitList(*queryNames, ",")
+	options.Buckets = splitList(*buckets, ",")
+	options.Aggregates = splitList(*aggregates, ";")
 	options.Verbose = *verbose
+	options.MaxErrors = *maxErrors
+	options.QueryTimeout = *queryTimeout
+	options.OutputFormat = *outputFormat
+	options.OutputFilePath = *outputFile
+	options.RawFilePath = *rawFile
+	options.PrintHistogram = *printHistogram
+	options.Breakdown = *breakdown
+	options.TopHosts = *topHosts
+	options.Duration = *duration
+	options.Iterations = *iterations
+	options.Rate = *rate
+	options.Arrivals = *arrivals
+	options.WarmupDuration = *warmupDuration
+	options.WarmupQueries = *warmupQueries
+	options.MaxOpenConns = *maxOpenConns
+	options.MaxIdleConns = *maxIdleConns
+	options.ConnMaxLifetime = *connMaxLifetime
+	options.PrewarmConns = *prewarmConns
+	options.ConnMode = *connMode
+	options.Driver = *driver
+	options.Protocol = *protocol
+	options.VerifyFilePath = *verifyFile
+	options.VerifyReferencePath = *verifyReference
+	options.SaveGoldenPath = *saveGolden
+	options.Progress = *showProgress
+	options.Interval = *interval
+	options.IntervalFilePath = *intervalFile
+	options.MetricsAddr = *metricsAddr
+	options.BaselinePath = *baseline
+	options.RegressionThreshold = *regressionThreshold
+	options.ExplainSlowest = *explainSlowest
+	options.ExplainFilePath = *explainFile
+
+	if options.Iterations < 0 {
+		usageError("invalid -iterations %d, must be positive", options.Iterations)
+	}
+	if options.QueryTimeout < 0 {
+		usageError("invalid -timeout %s, must be positive", options.QueryTimeout)
+	}
+	if options.Duration < 0 {
+		usageError("invalid -duration %s, must be positive", options.Duration)
+	}
+	if options.MaxErrors < 0 {
+		usageError("invalid -max-errors %d, must be positive", options.MaxErrors)
+	}
+	if options.WarmupDuration < 0 || options.WarmupQueries < 0 {
+		usageError("invalid -warmup or -warmup-queries, must be positive")
+	}
+	if options.MaxOpenConns < 0 || options.ConnMaxLifetime < 0 || options.PrewarmConns < 0 {
+		usageError("invalid -max-open-conns, -conn-max-lifetime or -prewarm, must be positive")
+	}
+	switch options.Driver {
+	case PQDriver, PGXDriver:
+	default:
+		usageError("unknown driver %s, expected pq or pgx", options.Driver)
+	}
+	switch options.Protocol {
+	case ExtendedProtocol, PreparedProtocol, SimpleProtocol:
+	default:
+		usageError("unknown protocol %s, expected extended, prepared or simple", options.Protocol)
+	}
+	switch options.ConnMode {
+	case PoolConns, DedicatedConns, BothConns:
+	default:
+		usageError("unknown conn mode %s, expected pool, dedicated or both", options.ConnMode)
+	}
+	if options.Rate < 0 {
+		usageError("invalid -rate %v, must be positive", options.Rate)
+	}
+	switch options.Arrivals {
+	case ConstantArrivals, PoissonArrivals:
+	default:
+		usageError("unknown arrivals %s, expected constant or poisson", options.Arrivals)
+	}
+	if options.Iterations == 0 && options.Duration == 0 {
+		// Without a duration, the default is a single pass over the input
+		options.Iterations = 1
+	}
+
+	var err error
+	options.Sweep, err = parseSweep(*sweep)
+	if err != nil {
+		usageError("invalid -sweep: %v", err)
+	}
+	if options.TopHosts < 0 {
+		usageError("invalid -top-hosts %d, must be positive", options.TopHosts)
+	}
+	if options.ExplainSlowest < 0 {
+		usageError("invalid -explain %d, must be positive", options.ExplainSlowest)
+	}
+	if options.ExplainSlowest > 0 && (len(options.Sweep) != 0 || options.ConnMode == BothConns) {
+		usageError("-explain can't be used with -sweep or -conn-mode both")
+	}
+	if options.ExplainFilePath == "" {
+		options.ExplainFilePath = explainFilePath(options.OutputFilePath)
+	}
+	if options.Interval < 0 {
+		usageError("invalid -interval %s, must be positive", options.Interval)
+	}
+	if options.Interval > 0 && (len(options.Sweep) != 0 || options.ConnMode == BothConns) {
+		usageError("-interval can't be used with -sweep or -conn-mode both")
+	}
+	if options.RegressionThreshold < 0 {
+		usageError("invalid -regression-threshold %v, must be positive", options.RegressionThreshold)
+	}
+	if options.BaselinePath != "" && (len(options.Sweep) != 0 || options.ConnMode == BothConns) {
+		usageError("-baseline can't be used with -sweep or -conn-mode both")
+	}
+	if options.IntervalFilePath == "" {
+		options.IntervalFilePath = sidecarFilePath(options.OutputFilePath, "intervals.csv")
+	}
+	options.Percentiles, err = parsePercentiles(*percentiles)
+	if err != nil {
+		usageError("invalid -p: %v", err)
+	}
+
+	switch options.OutputFormat {
+	case TextFormat, JSONFormat, CSVFormat:
+	default:
+		usageError("unknown output format %s, expected text, json or csv", options.OutputFormat)
+	}
 	options.DBConnectionString = *dbConnString
 
 	return options
 }
+
+// explainFilePath returns the default path for the plans of the slowest queries,
+// report.json has report.explain.json next to it
+func explainFilePath(outputFilePath string) string {
+	return sidecarFilePath(outputFilePath, "explain.json")
+}
+
+// sidecarFilePath returns the path for a file written alongside the report, e.g. for name
+// intervals.csv, report.json has report.intervals.csv next to it, and stdout has intervals.csv
+func sidecarFilePath(outputFilePath, name string) string {
+	if outputFilePath == "" || outputFilePath == "-" {
+		return name
+	}
+	return strings.TrimSuffix(outputFilePath, filepath.Ext(outputFilePath)) + "." + name
+}
+
+// usageError prints the error and the usage message, then exits like flag.Parse does for an invalid flag
+func usageError(format string, args ...interface{}) {
+	fmt.Fprintf(flag.CommandLine.Output(), format+"\n", args...)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// parsePercentiles parses a comma separated list of percentiles, like 90,99,99.9
+func parsePercentiles(value string) ([]float64, error) {
+	var percentiles []float64
+	for _, item := range splitList(value, ",") {
+		percentile, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a number", item)
+		}
+		if percentile <= 0 || percentile >= 100 {
+			return nil, fmt.Errorf("percentile %s must be between 0 and 100 (exclusive)", item)
+		}
+		percentiles = append(percentiles, percentile)
+	}
+	return percentiles, nil
+}
+
+// parseSweep parses a comma separated list of numbers of workers, which can include ranges like 1-8
+func parseSweep(value string) ([]int, error) {
+	var sweep []int
+	for _, item := range splitList(value, ",") {
+		first, last := item, item
+		if i := strings.Index(item, "-"); i > 0 {
+			first, last = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a number", first)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a number", last)
+		}
+		if from < 1 || to < from {
+			return nil, fmt.Errorf("%s must be a positive number of workers or an increasing range", item)
+		}
+		for n := from; n <= to; n++ {
+			sweep = append(sweep, n)
+		}
+	}
+	return sweep, nil
+}
+
+// splitList splits a flag value on sep, trimming whitespace and dropping empty items
+func splitList(value, sep string) []string {
+	var items []string
+	for _, item := range strings.Split(value, sep) {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
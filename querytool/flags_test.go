@@ -0,0 +1,49 @@
+package querytool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSweep(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []int
+		err      string
+	}{
+		{value: "", expected: nil},
+		{value: "1,2,4,8", expected: []int{1, 2, 4, 8}},
+		{value: "1-4, 8, 16 - 17", expected: []int{1, 2, 3, 4, 8, 16, 17}},
+		{value: "0", err: "0 must be a positive number of workers or an increasing range"},
+		{value: "4-2", err: "4-2 must be a positive number of workers or an increasing range"},
+		{value: "1-x", err: "x is not a number"},
+		{value: "-1", err: "-1 must be a positive number of workers or an increasing range"},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		sweep, err := parseSweep(test.value)
+		if test.err != "" {
+			a.EqualError(err, test.err)
+		} else {
+			a.Nil(err)
+			a.Equal(sweep, test.expected)
+		}
+	}
+}
+
+func TestExplainFilePath(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(explainFilePath("-"), "explain.json")
+	a.Equal(explainFilePath(""), "explain.json")
+	a.Equal(explainFilePath("results/report.json"), "results/report.explain.json")
+	a.Equal(explainFilePath("report"), "report.explain.json")
+}
+
+func TestSidecarFilePath(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(sidecarFilePath("-", "intervals.csv"), "intervals.csv")
+	a.Equal(sidecarFilePath("results/report.txt", "intervals.csv"), "results/report.intervals.csv")
+}
@@ -0,0 +1,242 @@
+package querytool
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// Histogram records durations in bounded memory, in the style of an HDR histogram
+// (see http://hdrhistogram.org/). Values are counted in buckets which are exact below
+// 2048ns and then have a width of 1/1024 of their value, so any value read back
+// from the histogram is within 0.1% of a recorded value (3 significant digits.)
+//
+// Unlike a typical HDR histogram the counts are stored sparsely in a map, so there's no
+// upper limit on the values and memory is proportional to the number of distinct buckets
+// used, usually a few hundred, rather than the range. That makes it cheap to keep many
+// of them, e.g. per worker or per host. Histograms can be merged, the result is the same
+// as if all the values had been recorded in one histogram.
+//
+// The min, max, total, mean and standard deviation are tracked exactly.
+type Histogram struct {
+	counts   map[int32]int64
+	count    int64
+	min, max time.Duration
+	total    time.Duration
+	// Welford's running mean and sum of squares of the differences from the mean, in milliseconds.
+	// This algorithm is more numerically stable than most other algorithms for calculating the
+	// variance, and it can be merged with Chan et al.'s parallel algorithm.
+	mean, sq float64
+}
+
+const (
+	// subBucketBits determines the precision, 2^11 = 2048 > 2 * 10^3 for 3 significant digits
+	subBucketBits      = 11
+	subBucketCount     = 1 << subBucketBits
+	subBucketHalfCount = subBucketCount / 2
+)
+
+// NewHistogram returns an empty Histogram
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make(map[int32]int64)}
+}
+
+// bucketIndex returns the index of the bucket containing the value.
+// Values below subBucketCount have their own bucket, larger values are
+// bucketed by their top subBucketBits bits.
+func bucketIndex(value int64) int32 {
+	if value < subBucketCount {
+		if value < 0 {
+			return 0
+		}
+		return int32(value)
+	}
+	shift := bits.Len64(uint64(value)) - subBucketBits
+	top := value >> uint(shift) // in [subBucketHalfCount, subBucketCount)
+	return int32(subBucketCount + (shift-1)*subBucketHalfCount + int(top-subBucketHalfCount))
+}
+
+// bucketRange returns the lowest and highest values in the bucket at index
+func bucketRange(index int32) (lowest, highest int64) {
+	if index < subBucketCount {
+		return int64(index), int64(index)
+	}
+	offset := int(index) - subBucketCount
+	shift := uint(offset/subBucketHalfCount + 1)
+	top := int64(offset%subBucketHalfCount + subBucketHalfCount)
+	return top << shift, (top+1)<<shift - 1
+}
+
+// Record adds the duration to the histogram
+func (h *Histogram) Record(d time.Duration) {
+	h.counts[bucketIndex(int64(d))]++
+	h.total += d
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+
+	h.count++
+	x := millis(d)
+	nextMean := h.mean + (x-h.mean)/float64(h.count)
+	h.sq += (x - h.mean) * (x - nextMean)
+	h.mean = nextMean
+}
+
+// RecordN adds the duration to the histogram n times
+func (h *Histogram) RecordN(d time.Duration, n int64) {
+	if n <= 0 {
+		return
+	}
+	h.Merge(&Histogram{
+		counts: map[int32]int64{bucketIndex(int64(d)): n},
+		count:  n,
+		min:    d,
+		max:    d,
+		total:  d * time.Duration(n),
+		mean:   millis(d),
+	})
+}
+
+// Merge adds all the values recorded in other to this histogram
+func (h *Histogram) Merge(other *Histogram) {
+	if other.count == 0 {
+		return
+	}
+	for index, count := range other.counts {
+		h.counts[index] += count
+	}
+	if h.count == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+	h.total += other.total
+
+	n := float64(h.count + other.count)
+	delta := other.mean - h.mean
+	h.sq += other.sq + delta*delta*float64(h.count)*float64(other.count)/n
+	h.mean += delta * float64(other.count) / n
+	h.count += other.count
+}
+
+// Count returns the number of values recorded
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+// Total returns the sum of the values recorded
+func (h *Histogram) Total() time.Duration {
+	return h.total
+}
+
+// HistogramBucket is a non-empty bucket of a Histogram
+type HistogramBucket struct {
+	// Value is the middle of the range of values counted in the bucket
+	Value time.Duration
+	Count int64
+}
+
+// Buckets returns the non-empty buckets, ordered by value
+func (h *Histogram) Buckets() []HistogramBucket {
+	indexes := make([]int32, 0, len(h.counts))
+	for index := range h.counts {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	buckets := make([]HistogramBucket, len(indexes))
+	for i, index := range indexes {
+		lowest, highest := bucketRange(index)
+		buckets[i] = HistogramBucket{
+			Value: time.Duration(lowest + (highest-lowest)/2),
+			Count: h.counts[index],
+		}
+	}
+	return buckets
+}
+
+// ValuesAtPercentiles returns the value at each percentile, in the range (0, 100].
+// The value at a rank is the highest value in the bucket containing it (which is
+// within 0.1% of a recorded value), but never more than the max or less than the min.
+func (h *Histogram) ValuesAtPercentiles(percentiles []float64) []time.Duration {
+	values := make([]time.Duration, len(percentiles))
+	if h.count == 0 {
+		return values
+	}
+
+	indexes := make([]int32, 0, len(h.counts))
+	for index := range h.counts {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	for i, percentile := range percentiles {
+		// If the rank is a whole number the value is the average of the value at that rank and
+		// the next one, otherwise it's the value at the rank rounded up, so the median of an even
+		// number of values is the average of the two middle values
+		index := percentile * float64(h.count) / 100
+		rank := int64(math.Ceil(index))
+		if rank < 1 {
+			rank = 1
+		}
+		values[i] = h.valueAtRank(indexes, rank)
+		if float64(rank) == index && rank < h.count {
+			values[i] = (values[i] + h.valueAtRank(indexes, rank+1)) / 2
+		}
+	}
+	return values
+}
+
+// valueAtRank returns the rank-th smallest value (from 1), the indexes are the sorted bucket indexes
+func (h *Histogram) valueAtRank(indexes []int32, rank int64) time.Duration {
+	var cumulative int64
+	for _, index := range indexes {
+		cumulative += h.counts[index]
+		if cumulative >= rank {
+			_, highest := bucketRange(index)
+			return h.clamp(time.Duration(highest))
+		}
+	}
+	return h.max
+}
+
+func (h *Histogram) clamp(value time.Duration) time.Duration {
+	if value > h.max {
+		return h.max
+	}
+	if value < h.min {
+		return h.min
+	}
+	return value
+}
+
+// Summary computes the SummaryStats for the recorded values, including the given percentiles.
+// The histogram must not be empty.
+func (h *Histogram) Summary(percentiles []float64) SummaryStats {
+	if h.count == 0 {
+		// This is programmer error, not a runtime error, so we panic
+		panic("histogram cannot be empty")
+	}
+
+	// The median is the 50th percentile, so compute it at the same time as the others
+	values := h.ValuesAtPercentiles(append([]float64{50}, percentiles...))
+	percentileValues := make([]Percentile, len(percentiles))
+	for i, percentile := range percentiles {
+		percentileValues[i] = Percentile{Percentile: percentile, Value: values[i+1]}
+	}
+
+	return SummaryStats{
+		Min:         h.min,
+		Max:         h.max,
+		Total:       h.total,
+		Median:      values[0],
+		Average:     h.total / time.Duration(h.count),
+		StdDev:      math.Sqrt(h.sq / float64(h.count)),
+		Percentiles: percentileValues,
+	}
+}
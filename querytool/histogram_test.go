@@ -0,0 +1,95 @@
+package querytool
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketIndex(t *testing.T) {
+	a := assert.New(t)
+	values := []int64{0, 1, 2047, 2048, 2049, 4095, 4096, 123456789, int64(time.Hour), 1 << 62}
+	for i, value := range values {
+		t.Logf("test #%d", i+1)
+		lowest, highest := bucketRange(bucketIndex(value))
+		a.LessOrEqual(lowest, value)
+		a.GreaterOrEqual(highest, value)
+		// The bucket is never wider than 1/1024 of the values in it
+		a.LessOrEqual(float64(highest-lowest), float64(lowest)/1024)
+	}
+
+	// Bucket indexes are ordered by value
+	a.Less(bucketIndex(2047), bucketIndex(2048))
+	a.Less(bucketIndex(4095), bucketIndex(4096))
+	a.Equal(bucketIndex(4096), bucketIndex(4097))
+}
+
+func TestHistogramMerge(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	all := NewHistogram()
+	parts := []*Histogram{NewHistogram(), NewHistogram(), NewHistogram()}
+	for i := 0; i < 10000; i++ {
+		d := time.Duration(random.ExpFloat64() * float64(20*time.Millisecond))
+		all.Record(d)
+		parts[i%len(parts)].Record(d)
+	}
+
+	merged := NewHistogram()
+	for _, part := range parts {
+		merged.Merge(part)
+	}
+	// Merging an empty histogram does nothing
+	merged.Merge(NewHistogram())
+
+	a := assert.New(t)
+	a.Equal(merged.Count(), all.Count())
+	a.Equal(merged.Total(), all.Total())
+	a.Equal(merged.Buckets(), all.Buckets())
+
+	percentiles := []float64{50, 90, 99, 99.9}
+	expected := all.Summary(percentiles)
+	actual := merged.Summary(percentiles)
+	a.Equal(actual.Min, expected.Min)
+	a.Equal(actual.Max, expected.Max)
+	a.Equal(actual.Median, expected.Median)
+	a.Equal(actual.Percentiles, expected.Percentiles)
+	a.InEpsilon(actual.StdDev, expected.StdDev, 1e-9)
+}
+
+func TestHistogramRecordN(t *testing.T) {
+	expected := NewHistogram()
+	actual := NewHistogram()
+	for _, d := range []time.Duration{5 * time.Millisecond, 20 * time.Millisecond} {
+		for i := 0; i < 3; i++ {
+			expected.Record(d)
+		}
+		actual.RecordN(d, 3)
+	}
+	actual.RecordN(time.Second, 0)
+
+	a := assert.New(t)
+	a.Equal(actual.Count(), int64(6))
+	a.Equal(actual.Total(), expected.Total())
+	a.Equal(actual.Buckets(), expected.Buckets())
+	a.InEpsilon(actual.Summary(nil).StdDev, expected.Summary(nil).StdDev, 1e-9)
+}
+
+func TestHistogramPrecision(t *testing.T) {
+	h := NewHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	a := assert.New(t)
+	// The ranks aren't whole numbers, so the values aren't averaged
+	values := h.ValuesAtPercentiles([]float64{0.05, 49.95, 98.95, 100})
+	expected := []time.Duration{time.Millisecond, 500 * time.Millisecond, 990 * time.Millisecond, 1000 * time.Millisecond}
+	for i, value := range values {
+		t.Logf("test #%d", i+1)
+		a.InEpsilon(int64(value), int64(expected[i]), 0.001)
+	}
+	// Percentiles never go past the min and max
+	a.Equal(values[3], 1000*time.Millisecond)
+}
@@ -0,0 +1,191 @@
+package querytool
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// IntervalStats are the stats of the queries that completed in an interval of the run,
+// see Options.Interval. The intervals show how the throughput and latency changed
+// during the run, e.g. when autovacuum kicks in, which the summary averages away.
+type IntervalStats struct {
+	// Start and End are the offsets of the interval from the start of the run
+	Start, End time.Duration
+	Queries    int
+	Succeeded  int
+	Failed     int
+	TimedOut   int
+	// Histogram has the durations of the successful queries
+	Histogram *Histogram
+}
+
+// intervalPercentiles are the percentiles of the query durations reported for each interval
+var intervalPercentiles = []float64{50, 95, 99}
+
+// intervalCSVHeader is followed by the intervalPercentiles and max_ms
+var intervalCSVHeader = []string{"start_s", "end_s", "queries", "succeeded", "failed", "timed_out", "qps"}
+
+// intervalRecorder splits the run into intervals, recording the queries completed in each.
+// It prints the stats of each interval when it ends, and writes them to a CSV file.
+type intervalRecorder struct {
+	start     time.Time
+	current   IntervalStats
+	intervals []IntervalStats
+	output    io.Writer
+	file      io.WriteCloser
+	csv       *csv.Writer
+	path      string
+}
+
+// newIntervalRecorder returns an intervalRecorder for a run that started at start,
+// it prints the intervals to output and writes them to file, if they're not nil
+func newIntervalRecorder(output io.Writer, file io.WriteCloser, path string, start time.Time) (*intervalRecorder, error) {
+	recorder := &intervalRecorder{
+		start:   start,
+		current: IntervalStats{Histogram: NewHistogram()},
+		output:  output,
+		file:    file,
+		path:    path,
+	}
+	if file != nil {
+		recorder.csv = csv.NewWriter(file)
+		header := append([]string{}, intervalCSVHeader...)
+		for _, percentile := range intervalPercentiles {
+			header = append(header, percentileName(percentile)+"_ms")
+		}
+		if err := recorder.csv.Write(append(header, "max_ms")); err != nil {
+			return nil, err
+		}
+	}
+	return recorder, nil
+}
+
+// add records the stats of a query that completed in the current interval
+func (recorder *intervalRecorder) add(stats *QueryStats) {
+	interval := &recorder.current
+	interval.Queries++
+	switch stats.Outcome() {
+	case Succeeded:
+		interval.Succeeded++
+		interval.Histogram.Record(stats.Duration)
+	case Failed:
+		interval.Failed++
+	case TimedOut:
+		interval.TimedOut++
+	}
+}
+
+// next ends the current interval at now, and starts the next one
+func (recorder *intervalRecorder) next(now time.Time) error {
+	interval := recorder.current
+	interval.End = now.Sub(recorder.start)
+	recorder.intervals = append(recorder.intervals, interval)
+	recorder.current = IntervalStats{Start: interval.End, Histogram: NewHistogram()}
+
+	report := newIntervalReport(&interval)
+	if recorder.output != nil {
+		report.print(recorder.output)
+	}
+	if recorder.csv != nil {
+		recorder.csv.Write(report.csvRecord())
+		// Flush every interval, so the file can be followed during a long run
+		recorder.csv.Flush()
+		if err := recorder.csv.Error(); err != nil {
+			return fmt.Errorf("error writing %s: %w", recorder.path, err)
+		}
+	}
+	return nil
+}
+
+// finish ends the last interval at now, if any queries completed in it,
+// and returns all the intervals
+func (recorder *intervalRecorder) finish(now time.Time) ([]IntervalStats, error) {
+	var err error
+	if recorder.current.Queries != 0 {
+		err = recorder.next(now)
+	}
+	return recorder.intervals, err
+}
+
+// Close closes the CSV file, if there is one
+func (recorder *intervalRecorder) Close() error {
+	if recorder.file == nil {
+		return nil
+	}
+	if err := recorder.file.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %w", recorder.path, err)
+	}
+	return nil
+}
+
+// IntervalReport is the part of the Report for an interval of the run, see IntervalStats
+type IntervalReport struct {
+	StartS    float64 `json:"start_s"`
+	EndS      float64 `json:"end_s"`
+	Queries   int     `json:"queries"`
+	Succeeded int     `json:"succeeded"`
+	Failed    int     `json:"failed"`
+	TimedOut  int     `json:"timed_out"`
+	// QPS is the number of queries completed per second in the interval
+	QPS float64 `json:"qps"`
+	// Summary has the intervalPercentiles, it's nil if no queries succeeded in the interval
+	Summary *SummaryStats `json:"summary"`
+}
+
+func newIntervalReport(interval *IntervalStats) IntervalReport {
+	report := IntervalReport{
+		StartS:    interval.Start.Seconds(),
+		EndS:      interval.End.Seconds(),
+		Queries:   interval.Queries,
+		Succeeded: interval.Succeeded,
+		Failed:    interval.Failed,
+		TimedOut:  interval.TimedOut,
+		Summary:   summarize(interval.Histogram, intervalPercentiles),
+	}
+	if interval.End > interval.Start {
+		report.QPS = float64(interval.Queries) / (interval.End - interval.Start).Seconds()
+	}
+	return report
+}
+
+// print writes a line with the stats of the interval, as it ends
+func (report *IntervalReport) print(w io.Writer) {
+	fmt.Fprintf(w, "[%7.1fs] %d queries, %.1f queries/second, %d failed, %d timed out",
+		report.EndS, report.Queries, report.QPS, report.Failed, report.TimedOut)
+	if stats := report.Summary; stats != nil {
+		for _, p := range stats.Percentiles {
+			fmt.Fprintf(w, ", %s %.2fms", percentileName(p.Percentile), millis(p.Value))
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// csvRecord returns the interval as a row of the CSV file, see intervalCSVHeader
+func (report *IntervalReport) csvRecord() []string {
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	record := []string{
+		formatFloat(report.StartS),
+		formatFloat(report.EndS),
+		strconv.Itoa(report.Queries),
+		strconv.Itoa(report.Succeeded),
+		strconv.Itoa(report.Failed),
+		strconv.Itoa(report.TimedOut),
+		formatFloat(report.QPS),
+	}
+	if stats := report.Summary; stats != nil {
+		for _, p := range stats.Percentiles {
+			record = append(record, formatFloat(millis(p.Value)))
+		}
+		return append(record, formatFloat(millis(stats.Max)))
+	}
+	// The latencies are empty if no queries succeeded
+	for range intervalPercentiles {
+		record = append(record, "")
+	}
+	return append(record, "")
+}
@@ -0,0 +1,51 @@
+package querytool
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntervalRecorder(t *testing.T) {
+	a := assert.New(t)
+	start := time.Date(2022, 2, 1, 12, 0, 0, 0, time.UTC)
+	var printed strings.Builder
+	output := &nopCloser{}
+	recorder, err := newIntervalRecorder(&printed, output, "intervals.csv", start)
+	a.Nil(err)
+
+	recorder.add(&QueryStats{Query: "a", Duration: 10 * time.Millisecond})
+	recorder.add(&QueryStats{Query: "a", Duration: 20 * time.Millisecond})
+	recorder.add(&QueryStats{Query: "a", Err: &QueryError{Class: SQLError, Err: errors.New("syntax error")}})
+	a.Nil(recorder.next(start.Add(time.Second)))
+	// An interval without any successful queries has no latencies
+	recorder.add(&QueryStats{Query: "a", Err: &QueryError{Class: TimeoutError, Err: errors.New("timeout")}})
+	a.Nil(recorder.next(start.Add(2 * time.Second)))
+	// The last interval is cut short, and only kept if queries completed in it
+	recorder.add(&QueryStats{Query: "a", Duration: 30 * time.Millisecond})
+	intervals, err := recorder.finish(start.Add(2500 * time.Millisecond))
+	a.Nil(err)
+
+	a.Len(intervals, 3)
+	a.Equal(intervals[0].Start, time.Duration(0))
+	a.Equal(intervals[0].End, time.Second)
+	a.Equal(intervals[0].Queries, 3)
+	a.Equal(intervals[0].Succeeded, 2)
+	a.Equal(intervals[0].Failed, 1)
+	a.Equal(intervals[1].TimedOut, 1)
+	a.Equal(intervals[2].Start, 2*time.Second)
+	a.Equal(newIntervalReport(&intervals[2]).QPS, 2.0)
+
+	// The percentiles are within 0.1% of the values, because they're computed from a Histogram
+	a.Equal(printed.String(),
+		"[    1.0s] 3 queries, 3.0 queries/second, 1 failed, 0 timed out, p50 15.00ms, p95 20.00ms, p99 20.00ms\n"+
+			"[    2.0s] 1 queries, 1.0 queries/second, 0 failed, 1 timed out\n"+
+			"[    2.5s] 1 queries, 2.0 queries/second, 0 failed, 0 timed out, p50 30.00ms, p95 30.00ms, p99 30.00ms\n")
+	a.Equal(output.String(), "start_s,end_s,queries,succeeded,failed,timed_out,qps,p50_ms,p95_ms,p99_ms,max_ms\n"+
+		"0,1,3,2,1,0,3,15.001215,20,20,20\n"+
+		"1,2,1,0,0,1,1,,,,\n"+
+		"2,2.5,1,1,0,0,2,30,30,30,30\n")
+}
@@ -7,14 +7,21 @@ import (
 	"log"
 	"os"
 	"sort"
+	"strconv"
 	"time"
 )
 
 // The supported datetime format in the CSV file
 const timeFormat = "2006-01-02 15:04:05"
 
-// LoadTasks loads
-func LoadTasks(csvFilePath string) (*TaskQueue, error) {
+// The CSV column containing the host, queries are grouped into tasks by host
+const hostColumn = "hostname"
+
+// The columns of a CSV file without a header row, these match data/query_params.csv
+var defaultColumns = []string{hostColumn, "start_time", "end_time"}
+
+// LoadTasks loads the CSV input and binds each row to each of the query templates
+func LoadTasks(csvFilePath string, templates []*QueryTemplate) (*TaskQueue, error) {
 	input := os.Stdin
 	if csvFilePath != "" && csvFilePath != "-" {
 		// Load the CSV input from the file at path
@@ -25,7 +32,7 @@ func LoadTasks(csvFilePath string) (*TaskQueue, error) {
 		}
 	}
 
-	queries, err := loadCSV(input)
+	queries, err := loadCSV(input, templates)
 	if err != nil {
 		return nil, fmt.Errorf("LoadTasks: %w", err)
 	}
@@ -65,12 +72,22 @@ func LoadTasks(csvFilePath string) (*TaskQueue, error) {
 	return NewTaskQueue(tasks), nil
 }
 
-// loadCSV parses the CSV file in reader into a slice of CPUQuery structs
-func loadCSV(reader io.Reader) ([]CPUQuery, error) {
-	var queries []CPUQuery
+// loadCSV parses the CSV file in reader and binds each row to each of
+// the templates, returning the resulting queries.
+func loadCSV(reader io.Reader, templates []*QueryTemplate) ([]Query, error) {
+	var queries []Query
+
+	columns := defaultColumns
+	// The type of each column is determined by the template params bound to it.
+	// The bindings are the indexes of each template's params in the columns.
+	var columnTypes []ParamType
+	var bindings [][]int
 
 	hasHeader := false
+	numRows := 0
 	csvReader := csv.NewReader(reader)
+	// We check the number of values in each row ourselves for a better error message
+	csvReader.FieldsPerRecord = -1
 	for {
 		record, err := csvReader.Read()
 		if err == io.EOF {
@@ -80,31 +97,100 @@ func loadCSV(reader io.Reader) ([]CPUQuery, error) {
 			return nil, fmt.Errorf("error reading CSV: %w", err)
 		}
 
-		line := len(queries)
+		line := numRows
 		if hasHeader {
 			line += 2
 		} else {
 			line++
 		}
 
-		if len(record) != 3 {
-			return nil, fmt.Errorf("line %d: expected CSV row to contain 3 values: got %d", line, len(record))
-		}
-		if len(queries) == 0 && record[0] == "hostname" {
-			// This is the header row, skip it
+		if numRows == 0 && !hasHeader && record[0] == hostColumn {
+			// This is the header row, it names the columns
 			hasHeader = true
+			columns = record
 			continue
 		}
 
-		start, err := time.Parse(timeFormat, record[1])
-		if err != nil {
-			return nil, fmt.Errorf("line %d: start time must be formatted like %s, not %s", line, timeFormat, record[1])
+		if columnTypes == nil {
+			columnTypes, bindings, err = bindColumns(columns, templates)
+			if err != nil {
+				return nil, err
+			}
 		}
-		end, err := time.Parse(timeFormat, record[2])
-		if err != nil {
-			return nil, fmt.Errorf("line %d: end time must be formatted like %s, not %s", line, timeFormat, record[2])
+
+		if len(record) != len(columns) {
+			return nil, fmt.Errorf("line %d: expected CSV row to contain %d values: got %d", line, len(columns), len(record))
+		}
+
+		values := make([]interface{}, len(record))
+		for i, value := range record {
+			values[i], err = parseValue(value, columnTypes[i])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s %v", line, columns[i], err)
+			}
+		}
+
+		for i, template := range templates {
+			args := make([]interface{}, len(bindings[i]))
+			for j, column := range bindings[i] {
+				args[j] = values[column]
+			}
+			queries = append(queries, Query{
+				Template: template,
+				Host:     record[0],
+				Args:     args,
+			})
+		}
+		numRows++
+	}
+
+	return queries, nil
+}
+
+// bindColumns finds the column for each param of each template and
+// determines the type of each column from the params bound to it.
+func bindColumns(columns []string, templates []*QueryTemplate) ([]ParamType, [][]int, error) {
+	if columns[0] != hostColumn {
+		return nil, nil, fmt.Errorf("the first CSV column must be %s, not %s", hostColumn, columns[0])
+	}
+
+	columnIndexes := make(map[string]int, len(columns))
+	for i, column := range columns {
+		columnIndexes[column] = i
+	}
+
+	columnTypes := make([]ParamType, len(columns))
+	typed := make([]bool, len(columns))
+	bindings := make([][]int, len(templates))
+	for i, template := range templates {
+		bindings[i] = make([]int, len(template.Params))
+		for j, param := range template.Params {
+			column, ok := columnIndexes[param.Name]
+			if !ok && template.builtin && len(columns) == len(defaultColumns) {
+				// Older files name the columns differently, e.g. hostname,start,end,
+				// the built-in template binds them by position like a file without a header
+				column, ok = j, true
+			}
+			if !ok {
+				return nil, nil, fmt.Errorf("query template %s: param %s is not a CSV column", template.Name, param.Name)
+			}
+			if typed[column] && columnTypes[column] != param.Type {
+				return nil, nil, fmt.Errorf("query template %s: param %s is a %s, but another template uses it as a %s",
+					template.Name, param.Name, param.Type, columnTypes[column])
+			}
+			columnTypes[column] = param.Type
+			typed[column] = true
+			bindings[i][j] = column
 		}
+	}
+
+	return columnTypes, bindings, nil
+}
 
+// parseValue parses a CSV value as the given type
+func parseValue(value string, paramType ParamType) (interface{}, error) {
+	switch paramType {
+	case TimestampParam:
 		// There's the question of timezones here.
 		// The database uses timestamptz and the input
 		// data in cpu_usage.csv doesn't specify the timezone.
@@ -118,14 +204,24 @@ func loadCSV(reader io.Reader) ([]CPUQuery, error) {
 		// input and query times are treated the same way.
 		// Go also assumes UTC, so we don't need any code here.
 		// Otherwise we would use ParseInLocation instead.
-
-		query := CPUQuery{
-			Host:  record[0],
-			Start: start,
-			End:   end,
+		t, err := time.Parse(timeFormat, value)
+		if err != nil {
+			return nil, fmt.Errorf("must be formatted like %s, not %s", timeFormat, value)
+		}
+		return t, nil
+	case IntParam:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be an integer, not %s", value)
 		}
-		queries = append(queries, query)
+		return n, nil
+	case FloatParam:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a number, not %s", value)
+		}
+		return f, nil
+	default:
+		return value, nil
 	}
-
-	return queries, nil
 }
@@ -17,7 +17,7 @@ func TestLoadCSVError(t *testing.T) {
 		// Malformed header
 		{
 			csv: "host,start,end\n",
-			err: errors.New("line 1: start time must be formatted like 2006-01-02 15:04:05, not start"),
+			err: errors.New("line 1: start_time must be formatted like 2006-01-02 15:04:05, not start"),
 		},
 		// Too many values
 		{
@@ -32,72 +32,149 @@ func TestLoadCSVError(t *testing.T) {
 		// Malformed start date (missing time)
 		{
 			csv: "1,2006-01-02,2006-01-02 15:04:05",
-			err: errors.New("line 1: start time must be formatted like 2006-01-02 15:04:05, not 2006-01-02"),
+			err: errors.New("line 1: start_time must be formatted like 2006-01-02 15:04:05, not 2006-01-02"),
 		},
 		// Malformed start date (invalid)
 		{
 			csv: "bar,2006-13-02 15:04:05,2006-01-02 15:04:05",
-			err: errors.New("line 1: start time must be formatted like 2006-01-02 15:04:05, not 2006-13-02 15:04:05"),
+			err: errors.New("line 1: start_time must be formatted like 2006-01-02 15:04:05, not 2006-13-02 15:04:05"),
 		},
 		// Malformed end date (time zone)
+		{
+			csv: "hostname,start_time,end_time\nfoo,2006-01-02 15:04:05,2006-01-02 15:04:05Z07:00",
+			err: errors.New("line 2: end_time must be formatted like 2006-01-02 15:04:05, not 2006-01-02 15:04:05Z07:00"),
+		},
+		// Malformed end date, with the column names of older files
 		{
 			csv: "hostname,start,end\nfoo,2006-01-02 15:04:05,2006-01-02 15:04:05Z07:00",
-			err: errors.New("line 2: end time must be formatted like 2006-01-02 15:04:05, not 2006-01-02 15:04:05Z07:00"),
+			err: errors.New("line 2: end must be formatted like 2006-01-02 15:04:05, not 2006-01-02 15:04:05Z07:00"),
 		},
 		// Not a CSV
 		{
 			csv: "{foo\tbar\tbaz}",
 			err: errors.New("line 1: expected CSV row to contain 3 values: got 1"),
 		},
+		// Header is missing a column used by the template
+		{
+			csv: "hostname,start_time\nfoo,2006-01-02 15:04:05",
+			err: errors.New("query template cpu_stats: param end_time is not a CSV column"),
+		},
 	}
 
 	a := assert.New(t)
 	for i, test := range tests {
 		t.Logf("test #%d", i+1)
 
-		queries, err := loadCSV(strings.NewReader(test.csv))
+		queries, err := loadCSV(strings.NewReader(test.csv), DefaultTemplates())
 		a.Nil(queries)
 		a.Equal(err, test.err)
 	}
 }
 
 func TestLoadCSV(t *testing.T) {
-	csv := `hostname,start,end
+	csv := `hostname,start_time,end_time
 host_000008,2017-01-01 08:59:22,2017-01-01 09:59:22
 host_000001,2017-01-02 13:02:02,2017-01-02 14:02:02
 host_000008,2017-01-02 18:50:28,2017-01-02 19:50:28
 host_000002,2017-01-02 15:16:29,2017-01-02 16:16:29
 host_000003,2017-01-01 08:52:14,2017-01-01 09:52:14
 `
-	expected := []CPUQuery{
+	templates := DefaultTemplates()
+	cpuStats := templates[0]
+	expected := []Query{
 		{
-			Host:  "host_000008",
-			Start: time.Date(2017, 1, 1, 8, 59, 22, 0, time.UTC),
-			End:   time.Date(2017, 1, 1, 9, 59, 22, 0, time.UTC),
+			Template: cpuStats,
+			Host:     "host_000008",
+			Args: []interface{}{
+				"host_000008",
+				time.Date(2017, 1, 1, 8, 59, 22, 0, time.UTC),
+				time.Date(2017, 1, 1, 9, 59, 22, 0, time.UTC),
+			},
 		},
 		{
-			Host:  "host_000001",
-			Start: time.Date(2017, 1, 2, 13, 2, 2, 0, time.UTC),
-			End:   time.Date(2017, 1, 2, 14, 2, 2, 0, time.UTC),
+			Template: cpuStats,
+			Host:     "host_000001",
+			Args: []interface{}{
+				"host_000001",
+				time.Date(2017, 1, 2, 13, 2, 2, 0, time.UTC),
+				time.Date(2017, 1, 2, 14, 2, 2, 0, time.UTC),
+			},
 		},
 		{
-			Host:  "host_000008",
-			Start: time.Date(2017, 1, 2, 18, 50, 28, 0, time.UTC),
-			End:   time.Date(2017, 1, 2, 19, 50, 28, 0, time.UTC),
+			Template: cpuStats,
+			Host:     "host_000008",
+			Args: []interface{}{
+				"host_000008",
+				time.Date(2017, 1, 2, 18, 50, 28, 0, time.UTC),
+				time.Date(2017, 1, 2, 19, 50, 28, 0, time.UTC),
+			},
 		},
 		{
-			Host:  "host_000002",
-			Start: time.Date(2017, 1, 2, 15, 16, 29, 0, time.UTC),
-			End:   time.Date(2017, 1, 2, 16, 16, 29, 0, time.UTC),
+			Template: cpuStats,
+			Host:     "host_000002",
+			Args: []interface{}{
+				"host_000002",
+				time.Date(2017, 1, 2, 15, 16, 29, 0, time.UTC),
+				time.Date(2017, 1, 2, 16, 16, 29, 0, time.UTC),
+			},
+		},
+		{
+			Template: cpuStats,
+			Host:     "host_000003",
+			Args: []interface{}{
+				"host_000003",
+				time.Date(2017, 1, 1, 8, 52, 14, 0, time.UTC),
+				time.Date(2017, 1, 1, 9, 52, 14, 0, time.UTC),
+			},
+		},
+	}
+
+	queries, err := loadCSV(strings.NewReader(csv), templates)
+
+	assert.Nil(t, err)
+	assert.Equal(t, queries, expected)
+
+	// The built-in template binds the columns by position if the header doesn't name its params
+	csv = strings.Replace(csv, "hostname,start_time,end_time", "hostname,start,end", 1)
+	queries, err = loadCSV(strings.NewReader(csv), templates)
+
+	assert.Nil(t, err)
+	assert.Equal(t, queries, expected)
+}
+
+func TestLoadCSVMultipleTemplates(t *testing.T) {
+	csv := `hostname,start_time,end_time,limit
+host_000008,2017-01-01 08:59:22,2017-01-01 09:59:22,10
+`
+	templates := []*QueryTemplate{
+		{
+			Name:   "by_host",
+			SQL:    "SELECT * FROM cpu_usage WHERE host = $1 LIMIT $2",
+			Params: []QueryParam{{Name: "hostname"}, {Name: "limit", Type: IntParam}},
+		},
+		{
+			Name:   "by_time",
+			SQL:    "SELECT * FROM cpu_usage WHERE ts BETWEEN $1 AND $2",
+			Params: []QueryParam{{Name: "start_time", Type: TimestampParam}, {Name: "end_time", Type: TimestampParam}},
+		},
+	}
+	expected := []Query{
+		{
+			Template: templates[0],
+			Host:     "host_000008",
+			Args:     []interface{}{"host_000008", int64(10)},
 		},
 		{
-			Host:  "host_000003",
-			Start: time.Date(2017, 1, 1, 8, 52, 14, 0, time.UTC),
-			End:   time.Date(2017, 1, 1, 9, 52, 14, 0, time.UTC),
+			Template: templates[1],
+			Host:     "host_000008",
+			Args: []interface{}{
+				time.Date(2017, 1, 1, 8, 59, 22, 0, time.UTC),
+				time.Date(2017, 1, 1, 9, 59, 22, 0, time.UTC),
+			},
 		},
 	}
 
-	queries, err := loadCSV(strings.NewReader(csv))
+	queries, err := loadCSV(strings.NewReader(csv), templates)
 
 	assert.Nil(t, err)
 	assert.Equal(t, queries, expected)
@@ -0,0 +1,156 @@
+package querytool
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// metricsHostGroups is the number of groups the hosts are hashed into for the latency histogram,
+// a label for each host would make too many time series for Prometheus with thousands of hosts
+const metricsHostGroups = 16
+
+// metricsBuckets are the upper bounds of the latency histogram buckets, in seconds
+var metricsBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics exposes the progress of the benchmark in the Prometheus text format, so long runs
+// can be watched in Grafana next to the database's own metrics. It's fed the QueryStats of the
+// queries as they complete, including the warmup queries, see runBenchmark.
+// It's an http.Handler, see ServeMetrics.
+type Metrics struct {
+	mu      sync.Mutex
+	queries [TimedOut + 1]int64
+	// errors counts the failed and timed out queries by ErrorClass
+	errors map[ErrorClass]int64
+	// durations are the latency histograms of the successful queries, by host group
+	durations map[int]*metricsHistogram
+	// liveWorkers is the number of workers still running, nil between runs
+	liveWorkers *int32
+}
+
+// metricsHistogram is a Prometheus histogram, the counts are cumulative
+type metricsHistogram struct {
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+// NewMetrics returns Metrics with all the counters at zero
+func NewMetrics() *Metrics {
+	return &Metrics{
+		errors:    make(map[ErrorClass]int64),
+		durations: make(map[int]*metricsHistogram),
+	}
+}
+
+// ServeMetrics serves the metrics at /metrics on addr, e.g. :9100, until the server is closed.
+// It returns an error if it can't listen on addr.
+func ServeMetrics(addr string, metrics *Metrics) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("ServeMetrics failed to listen on %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go server.Serve(listener)
+	return server, nil
+}
+
+// add counts a completed query
+func (metrics *Metrics) add(stats *QueryStats) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	outcome := stats.Outcome()
+	metrics.queries[outcome]++
+	if outcome != Succeeded {
+		metrics.errors[stats.Err.Class]++
+		return
+	}
+
+	group := hostGroup(stats.Host)
+	histogram := metrics.durations[group]
+	if histogram == nil {
+		histogram = &metricsHistogram{buckets: make([]int64, len(metricsBuckets))}
+		metrics.durations[group] = histogram
+	}
+	seconds := stats.Duration.Seconds()
+	for i, bound := range metricsBuckets {
+		if seconds <= bound {
+			histogram.buckets[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+}
+
+// setLiveWorkers sets the counter of the workers still running, or nil when no benchmark is running
+func (metrics *Metrics) setLiveWorkers(liveWorkers *int32) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.liveWorkers = liveWorkers
+}
+
+// hostGroup returns the group of the host for the latency histogram
+func hostGroup(host string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(host))
+	return int(hash.Sum32() % metricsHostGroups)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(w)
+}
+
+// write writes the metrics, the counters for every outcome and error class are included even if they're zero
+func (metrics *Metrics) write(w io.Writer) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP queryhw_queries_total The number of queries completed, by outcome.")
+	fmt.Fprintln(w, "# TYPE queryhw_queries_total counter")
+	for _, outcome := range []Outcome{Succeeded, Failed, TimedOut} {
+		fmt.Fprintf(w, "queryhw_queries_total{outcome=%q} %d\n", outcome, metrics.queries[outcome])
+	}
+
+	fmt.Fprintln(w, "# HELP queryhw_query_errors_total The number of failed and timed out queries, by error class.")
+	fmt.Fprintln(w, "# TYPE queryhw_query_errors_total counter")
+	for _, class := range append([]ErrorClass{TimeoutError}, errorClasses...) {
+		fmt.Fprintf(w, "queryhw_query_errors_total{class=%q} %d\n", class, metrics.errors[class])
+	}
+
+	fmt.Fprintln(w, "# HELP queryhw_query_duration_seconds The durations of the successful queries, by host group.")
+	fmt.Fprintln(w, "# TYPE queryhw_query_duration_seconds histogram")
+	groups := make([]int, 0, len(metrics.durations))
+	for group := range metrics.durations {
+		groups = append(groups, group)
+	}
+	sort.Ints(groups)
+	for _, group := range groups {
+		histogram := metrics.durations[group]
+		for i, bound := range metricsBuckets {
+			fmt.Fprintf(w, "queryhw_query_duration_seconds_bucket{host_group=\"%d\",le=%q} %d\n",
+				group, strconv.FormatFloat(bound, 'f', -1, 64), histogram.buckets[i])
+		}
+		fmt.Fprintf(w, "queryhw_query_duration_seconds_bucket{host_group=\"%d\",le=\"+Inf\"} %d\n", group, histogram.count)
+		fmt.Fprintf(w, "queryhw_query_duration_seconds_sum{host_group=\"%d\"} %s\n",
+			group, strconv.FormatFloat(histogram.sum, 'f', -1, 64))
+		fmt.Fprintf(w, "queryhw_query_duration_seconds_count{host_group=\"%d\"} %d\n", group, histogram.count)
+	}
+
+	liveWorkers := 0
+	if metrics.liveWorkers != nil {
+		liveWorkers = int(atomic.LoadInt32(metrics.liveWorkers))
+	}
+	fmt.Fprintln(w, "# HELP queryhw_active_workers The number of workers running queries.")
+	fmt.Fprintln(w, "# TYPE queryhw_active_workers gauge")
+	fmt.Fprintf(w, "queryhw_active_workers %d\n", liveWorkers)
+}
@@ -0,0 +1,91 @@
+package querytool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	liveWorkers := int32(3)
+	metrics.setLiveWorkers(&liveWorkers)
+	metrics.add(&QueryStats{Host: "host_1", Duration: 3 * time.Millisecond})
+	metrics.add(&QueryStats{Host: "host_1", Duration: 200 * time.Millisecond})
+	metrics.add(&QueryStats{Host: "host_2", Err: &QueryError{Class: SQLError, Err: errors.New("syntax error")}})
+	metrics.add(&QueryStats{Host: "host_2", Err: &QueryError{Class: TimeoutError, Err: errors.New("timeout")}})
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+	response, err := http.Get(server.URL)
+	a := assert.New(t)
+	a.Nil(err)
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	a.Nil(err)
+	a.Equal(response.Header.Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8")
+
+	group := hostGroup("host_1")
+	a.Equal(group, hostGroup("host_1"))
+	a.True(group >= 0 && group < metricsHostGroups)
+	// G is the host group of host_1
+	expected := `# HELP queryhw_queries_total The number of queries completed, by outcome.
+# TYPE queryhw_queries_total counter
+queryhw_queries_total{outcome="succeeded"} 2
+queryhw_queries_total{outcome="failed"} 1
+queryhw_queries_total{outcome="timed_out"} 1
+# HELP queryhw_query_errors_total The number of failed and timed out queries, by error class.
+# TYPE queryhw_query_errors_total counter
+queryhw_query_errors_total{class="timeout"} 1
+queryhw_query_errors_total{class="connection"} 0
+queryhw_query_errors_total{class="sql"} 1
+queryhw_query_errors_total{class="other"} 0
+# HELP queryhw_query_duration_seconds The durations of the successful queries, by host group.
+# TYPE queryhw_query_duration_seconds histogram
+queryhw_query_duration_seconds_bucket{host_group="G",le="0.001"} 0
+queryhw_query_duration_seconds_bucket{host_group="G",le="0.0025"} 0
+queryhw_query_duration_seconds_bucket{host_group="G",le="0.005"} 1
+queryhw_query_duration_seconds_bucket{host_group="G",le="0.01"} 1
+queryhw_query_duration_seconds_bucket{host_group="G",le="0.025"} 1
+queryhw_query_duration_seconds_bucket{host_group="G",le="0.05"} 1
+queryhw_query_duration_seconds_bucket{host_group="G",le="0.1"} 1
+queryhw_query_duration_seconds_bucket{host_group="G",le="0.25"} 2
+queryhw_query_duration_seconds_bucket{host_group="G",le="0.5"} 2
+queryhw_query_duration_seconds_bucket{host_group="G",le="1"} 2
+queryhw_query_duration_seconds_bucket{host_group="G",le="2.5"} 2
+queryhw_query_duration_seconds_bucket{host_group="G",le="5"} 2
+queryhw_query_duration_seconds_bucket{host_group="G",le="10"} 2
+queryhw_query_duration_seconds_bucket{host_group="G",le="+Inf"} 2
+queryhw_query_duration_seconds_sum{host_group="G"} 0.203
+queryhw_query_duration_seconds_count{host_group="G"} 2
+# HELP queryhw_active_workers The number of workers running queries.
+# TYPE queryhw_active_workers gauge
+queryhw_active_workers 3
+`
+	a.Equal(string(body), strings.ReplaceAll(expected, `host_group="G"`, fmt.Sprintf(`host_group="%d"`, group)))
+
+	// Between runs there are no active workers
+	metrics.setLiveWorkers(nil)
+	response, err = http.Get(server.URL)
+	a.Nil(err)
+	defer response.Body.Close()
+	body, err = io.ReadAll(response.Body)
+	a.Nil(err)
+	a.Contains(string(body), "\nqueryhw_active_workers 0\n")
+}
+
+func TestServeMetrics(t *testing.T) {
+	a := assert.New(t)
+	server, err := ServeMetrics("127.0.0.1:0", NewMetrics())
+	a.Nil(err)
+	a.Nil(server.Close())
+	_, err = ServeMetrics("not an address", NewMetrics())
+	a.NotNil(err)
+}
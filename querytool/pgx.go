@@ -0,0 +1,188 @@
+package querytool
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// pgxPool is the backend for the native pgx interface. It uses the binary format
+// for the params and results, except with the simple protocol.
+type pgxPool struct {
+	pool *pgxpool.Pool
+}
+
+// pgxDefaultMaxConns is the pool size if there's no MaxOpenConns, MaxIdleConns or NumWorkers,
+// pgxpool has a fixed size rather than separate limits for the open and idle connections.
+const pgxDefaultMaxConns = 4
+
+func openPGXPool(connectionString string, config PoolConfig) (*pgxPool, error) {
+	pgxConfig, err := pgxpool.ParseConfig(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	// The pool holds up to MaxOpenConns connections, which stay open while they're idle.
+	// Without a limit, it's the number of idle connections we'd keep with database/sql,
+	// or without idle connections the number of workers, so they don't wait for each other.
+	maxConns := config.MaxOpenConns
+	if maxConns == 0 {
+		maxConns = config.MaxIdleConns
+	}
+	if maxConns <= 0 {
+		maxConns = config.NumWorkers
+	}
+	if maxConns <= 0 {
+		maxConns = pgxDefaultMaxConns
+	}
+	pgxConfig.MaxConns = int32(maxConns)
+	pgxConfig.MaxConnLifetime = config.ConnMaxLifetime
+	if pgxConfig.MaxConnLifetime == 0 {
+		// pgxpool closes connections older than this, 0 would close them all
+		pgxConfig.MaxConnLifetime = time.Duration(math.MaxInt64)
+	}
+
+	switch config.Protocol {
+	case PreparedProtocol:
+		// This is the pgx default, it prepares and caches a statement for each query on each connection
+	case SimpleProtocol:
+		pgxConfig.ConnConfig.PreferSimpleProtocol = true
+		pgxConfig.ConnConfig.BuildStatementCache = nil
+	default:
+		// Without a statement cache pgx prepares an unnamed statement for every query
+		pgxConfig.ConnConfig.BuildStatementCache = nil
+	}
+
+	// Like sql.Open, don't connect until a connection is needed
+	pgxConfig.LazyConnect = true
+	pool, err := pgxpool.ConnectConfig(context.Background(), pgxConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &pgxPool{pool: pool}, nil
+}
+
+func (p *pgxPool) queryAndDiscard(ctx context.Context, query string, args ...interface{}) (fetchStats, error) {
+	return discardPGXRows(p.pool.Query(ctx, query, args...))
+}
+
+func (p *pgxPool) queryRows(ctx context.Context, query string, args ...interface{}) ([][]interface{}, fetchStats, error) {
+	return scanPGXRows(p.pool.Query(ctx, query, args...))
+}
+
+func (p *pgxPool) queryValue(ctx context.Context, query string, args ...interface{}) ([]byte, error) {
+	var value []byte
+	err := p.pool.QueryRow(ctx, query, args...).Scan(&value)
+	return value, err
+}
+
+func (p *pgxPool) conn(ctx context.Context) (dedicatedConn, error) {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pgxConn{conn}, nil
+}
+
+func (p *pgxPool) stats() PoolStats {
+	stats := p.pool.Stat()
+	// pgxpool doesn't count the connections it closed. It counts every acquire that had to
+	// wait for a connection, not just when the pool was full, and only the total time of
+	// all the acquires, which is close enough since the acquires that don't wait are fast.
+	return PoolStats{
+		MaxOpenConnections: int(stats.MaxConns()),
+		OpenConnections:    int(stats.TotalConns()),
+		WaitCount:          stats.EmptyAcquireCount(),
+		WaitDuration:       stats.AcquireDuration(),
+	}
+}
+
+// pgxConn is a dedicated pgx connection
+type pgxConn struct {
+	conn *pgxpool.Conn
+}
+
+func (c pgxConn) queryAndDiscard(ctx context.Context, query string, args ...interface{}) (fetchStats, error) {
+	return discardPGXRows(c.conn.Query(ctx, query, args...))
+}
+
+func (c pgxConn) queryRows(ctx context.Context, query string, args ...interface{}) ([][]interface{}, fetchStats, error) {
+	return scanPGXRows(c.conn.Query(ctx, query, args...))
+}
+
+func (c pgxConn) ping(ctx context.Context) error {
+	return c.conn.Ping(ctx)
+}
+
+func (c pgxConn) release() {
+	c.conn.Release()
+}
+
+// discardPGXRows fetches and discards the rows, returning the fetchStats
+func discardPGXRows(rows pgx.Rows, err error) (fetchStats, error) {
+	var stats fetchStats
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if stats.rows == 0 {
+			stats.firstRow = time.Now()
+		}
+		// Discard the result rows, the raw values are as sent by the server
+		stats.rows++
+		for _, value := range rows.RawValues() {
+			stats.bytes += int64(len(value))
+		}
+	}
+	if stats.rows == 0 {
+		stats.firstRow = time.Now()
+	}
+
+	return stats, rows.Err()
+}
+
+// scanPGXRows fetches the rows, returning their values converted by resultValue
+func scanPGXRows(rows pgx.Rows, err error) ([][]interface{}, fetchStats, error) {
+	var stats fetchStats
+	if err != nil {
+		return nil, stats, err
+	}
+	defer rows.Close()
+
+	var result [][]interface{}
+	for rows.Next() {
+		if stats.rows == 0 {
+			stats.firstRow = time.Now()
+		}
+		stats.rows++
+		for _, value := range rows.RawValues() {
+			stats.bytes += int64(len(value))
+		}
+		values, err := rows.Values()
+		if err != nil {
+			return nil, stats, err
+		}
+		for i, value := range values {
+			if numeric, ok := value.(pgtype.Numeric); ok {
+				// lib/pq returns numerics as text, pgx has its own type
+				var f float64
+				if err := numeric.AssignTo(&f); err != nil {
+					return nil, stats, err
+				}
+				value = f
+			}
+			values[i] = resultValue(value)
+		}
+		result = append(result, values)
+	}
+	if stats.rows == 0 {
+		stats.firstRow = time.Now()
+	}
+	return result, stats, rows.Err()
+}
@@ -0,0 +1,136 @@
+package querytool
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// How often the progress is shown, on a terminal it's refreshed in place,
+// otherwise (e.g. in a CI log) it's written as a new line each time
+const (
+	progressRefresh     = time.Second
+	progressLogInterval = 10 * time.Second
+)
+
+// progress shows how far along the benchmark is: the queries done out of the total,
+// the current throughput and p95 latency, and the estimated time remaining
+type progress struct {
+	output io.Writer
+	// tty is true if the output is a terminal, then the line is redrawn in place
+	tty   bool
+	start time.Time
+	// total is the number of queries to run, 0 if it's not limited, see TaskQueue.TotalQueries
+	total int
+	// duration is the time limit of the run, 0 if it's not limited, see Options.Duration
+	duration time.Duration
+	done     int
+	failed   int
+	// The queries completed since the last update, for the current throughput and p95
+	lastUpdate    time.Time
+	recent        int
+	recentSuccess *Histogram
+}
+
+// newProgress returns the progress for a run that started at start
+func newProgress(output io.Writer, tty bool, total int, duration time.Duration, start time.Time) *progress {
+	return &progress{
+		output:        output,
+		tty:           tty,
+		start:         start,
+		total:         total,
+		duration:      duration,
+		lastUpdate:    start,
+		recentSuccess: NewHistogram(),
+	}
+}
+
+// interval is how often update should be called
+func (p *progress) interval() time.Duration {
+	if p.tty {
+		return progressRefresh
+	}
+	return progressLogInterval
+}
+
+// add counts a completed query
+func (p *progress) add(stats *QueryStats) {
+	p.done++
+	p.recent++
+	switch stats.Outcome() {
+	case Succeeded:
+		p.recentSuccess.Record(stats.Duration)
+	case Failed, TimedOut:
+		p.failed++
+	}
+}
+
+// update shows the progress at now, the throughput and p95 are for the queries since the last update
+func (p *progress) update(now time.Time) {
+	line := fmt.Sprintf("%d", p.done)
+	if p.total > 0 {
+		line += fmt.Sprintf("/%d queries (%.1f%%)", p.total, 100*float64(p.done)/float64(p.total))
+	} else {
+		line += " queries"
+	}
+	if elapsed := now.Sub(p.lastUpdate); elapsed > 0 {
+		line += fmt.Sprintf(", %.1f queries/second", float64(p.recent)/elapsed.Seconds())
+	}
+	if p.recentSuccess.Count() != 0 {
+		p95 := p.recentSuccess.Summary([]float64{95}).Percentiles[0].Value
+		line += fmt.Sprintf(", p95 %.2fms", millis(p95))
+	}
+	if p.failed != 0 {
+		line += fmt.Sprintf(", %d failed", p.failed)
+	}
+	if eta, ok := p.eta(now); ok {
+		line += fmt.Sprintf(", ETA %s", eta)
+	}
+
+	if p.tty {
+		// Return to the start of the line and clear it, so a shorter line doesn't leave the end of the last one
+		fmt.Fprintf(p.output, "\r\033[K%s", line)
+	} else {
+		fmt.Fprintln(p.output, line)
+	}
+	p.lastUpdate = now
+	p.recent = 0
+	p.recentSuccess = NewHistogram()
+}
+
+// eta estimates the time remaining from the rate of the queries so far, or the time left of the duration,
+// whichever is sooner. It returns false if there's no estimate yet.
+func (p *progress) eta(now time.Time) (time.Duration, bool) {
+	elapsed := now.Sub(p.start)
+	var eta time.Duration
+	ok := false
+	if p.total > 0 && p.done > 0 {
+		eta = time.Duration(float64(elapsed) * float64(p.total-p.done) / float64(p.done))
+		ok = true
+	}
+	if p.duration > 0 {
+		left := p.duration - elapsed
+		if left < 0 {
+			left = 0
+		}
+		if !ok || left < eta {
+			eta = left
+		}
+		ok = true
+	}
+	return eta.Round(time.Second), ok
+}
+
+// clear removes the progress line from a terminal, before other output or the report
+func (p *progress) clear() {
+	if p.tty {
+		fmt.Fprint(p.output, "\r\033[K")
+	}
+}
+
+// isTerminal returns true if the file is a terminal (a character device), not a file or a pipe
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,55 @@
+package querytool
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgress(t *testing.T) {
+	a := assert.New(t)
+	start := time.Date(2022, 2, 1, 12, 0, 0, 0, time.UTC)
+	var output strings.Builder
+	p := newProgress(&output, false, 10, 0, start)
+	a.Equal(p.interval(), progressLogInterval)
+
+	p.add(&QueryStats{Duration: 10 * time.Millisecond})
+	p.add(&QueryStats{Duration: 20 * time.Millisecond})
+	p.add(&QueryStats{Err: &QueryError{Class: SQLError, Err: errors.New("syntax error")}})
+	p.update(start.Add(time.Second))
+	// The throughput and p95 are for the queries since the last update, the failures are for the whole run
+	p.add(&QueryStats{Duration: 30 * time.Millisecond})
+	p.update(start.Add(3 * time.Second))
+	p.update(start.Add(4 * time.Second))
+
+	a.Equal(output.String(), "3/10 queries (30.0%), 3.0 queries/second, p95 20.00ms, 1 failed, ETA 2s\n"+
+		"4/10 queries (40.0%), 0.5 queries/second, p95 30.00ms, 1 failed, ETA 5s\n"+
+		"4/10 queries (40.0%), 0.0 queries/second, 1 failed, ETA 6s\n")
+}
+
+func TestProgressTerminal(t *testing.T) {
+	a := assert.New(t)
+	start := time.Date(2022, 2, 1, 12, 0, 0, 0, time.UTC)
+	var output strings.Builder
+	// Without a limit on the number of queries, the ETA is the time left of the duration
+	p := newProgress(&output, true, 0, time.Minute, start)
+	a.Equal(p.interval(), progressRefresh)
+
+	p.add(&QueryStats{Duration: 10 * time.Millisecond})
+	p.update(start.Add(time.Second))
+	p.clear()
+	a.Equal(output.String(), "\r\033[K1 queries, 1.0 queries/second, p95 10.00ms, ETA 59s\r\033[K")
+
+	eta, ok := newProgress(&output, true, 0, 0, start).eta(start.Add(time.Second))
+	a.False(ok)
+	a.Equal(eta, time.Duration(0))
+	// With both, it's whichever is sooner
+	p = newProgress(&output, true, 100, time.Minute, start)
+	p.done = 90
+	eta, ok = p.eta(start.Add(9 * time.Second))
+	a.True(ok)
+	a.Equal(eta, time.Second)
+}
@@ -0,0 +1,196 @@
+package querytool
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RawWriter streams the QueryStats of every query to a file as they arrive,
+// so they can be analyzed with other tools. The file is CSV, unless the path
+// ends in .jsonl or .json, then it's JSON Lines (one JSON object per query.)
+type RawWriter struct {
+	file      io.WriteCloser
+	csv       *csv.Writer
+	json      *json.Encoder
+	start     time.Time
+	templates map[string]*QueryTemplate
+	// params are the names of all the template params, in the CSV they're columns
+	params []string
+}
+
+// RawRecord is a line in the JSON Lines raw results file
+type RawRecord struct {
+	Query         string                 `json:"query"`
+	Host          string                 `json:"host"`
+	WorkerId      int                    `json:"worker"`
+	Params        map[string]interface{} `json:"params"`
+	Outcome       string                 `json:"outcome"`
+	ErrorClass    string                 `json:"error_class,omitempty"`
+	Error         string                 `json:"error,omitempty"`
+	NumResultRows int                    `json:"rows"`
+	// NumResultBytes is the approximate size of the result values, see fetchStats
+	NumResultBytes int64     `json:"bytes"`
+	StartTime      time.Time `json:"start_time"`
+	// StartOffsetMs is when the query started relative to the start of the benchmark
+	StartOffsetMs float64 `json:"start_offset_ms"`
+	DurationMs    float64 `json:"duration_ms"`
+	// FirstRowMs and DrainMs are the QueryStats.TimeToFirstRow and DrainTime
+	FirstRowMs float64 `json:"first_row_ms"`
+	DrainMs    float64 `json:"drain_ms"`
+	// Warmup is true if the query is excluded from the stats because it ran in the warmup phase
+	Warmup bool `json:"warmup"`
+	// DelayMs is the QueryStats.Delay, it's included in the DurationMs but not the StartOffsetMs
+	DelayMs float64 `json:"delay_ms"`
+}
+
+var rawCSVHeader = []string{
+	"query", "host", "worker", "outcome", "error_class", "error", "rows", "bytes",
+	"start_time", "start_offset_ms", "duration_ms", "first_row_ms", "drain_ms", "warmup", "delay_ms",
+}
+
+// NewRawWriter creates the file at path for the results of the queries
+// created from templates. The start offsets are relative to start.
+func NewRawWriter(path string, templates []*QueryTemplate, start time.Time) (*RawWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("NewRawWriter failed to create %s: %w", path, err)
+	}
+
+	isJSON := strings.HasSuffix(path, ".jsonl") || strings.HasSuffix(path, ".json")
+	writer, err := newRawWriter(file, isJSON, templates, start)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("NewRawWriter: %w", err)
+	}
+	return writer, nil
+}
+
+func newRawWriter(file io.WriteCloser, isJSON bool, templates []*QueryTemplate, start time.Time) (*RawWriter, error) {
+	writer := &RawWriter{
+		file:      file,
+		start:     start,
+		templates: make(map[string]*QueryTemplate, len(templates)),
+	}
+	seen := make(map[string]bool)
+	for _, template := range templates {
+		writer.templates[template.Name] = template
+		for _, param := range template.Params {
+			if !seen[param.Name] {
+				seen[param.Name] = true
+				writer.params = append(writer.params, param.Name)
+			}
+		}
+	}
+
+	if isJSON {
+		writer.json = json.NewEncoder(file)
+		return writer, nil
+	}
+
+	writer.csv = csv.NewWriter(file)
+	// The param columns are prefixed, so they can't clash with the other columns
+	header := append([]string{}, rawCSVHeader...)
+	for _, name := range writer.params {
+		header = append(header, "param_"+name)
+	}
+	if err := writer.csv.Write(header); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Write writes the stats of a query
+func (writer *RawWriter) Write(stats *QueryStats) error {
+	record := RawRecord{
+		Query:          stats.Query,
+		Host:           stats.Host,
+		WorkerId:       stats.WorkerId,
+		Params:         make(map[string]interface{}),
+		Outcome:        stats.Outcome().String(),
+		NumResultRows:  stats.NumResultRows,
+		NumResultBytes: stats.NumResultBytes,
+		StartTime:      stats.Start.UTC(),
+		StartOffsetMs:  millis(stats.Start.Sub(writer.start)),
+		DurationMs:     millis(stats.Duration),
+		FirstRowMs:     millis(stats.TimeToFirstRow),
+		DrainMs:        millis(stats.DrainTime),
+		Warmup:         stats.Warmup,
+		DelayMs:        millis(stats.Delay),
+	}
+	if stats.Err != nil {
+		record.ErrorClass = stats.Err.Class.String()
+		record.Error = stats.Err.Error()
+	}
+	if template := writer.templates[stats.Query]; template != nil {
+		record.Params = formatParams(template, stats.Args)
+	}
+
+	if writer.json != nil {
+		return writer.json.Encode(&record)
+	}
+
+	row := []string{
+		record.Query,
+		record.Host,
+		strconv.Itoa(record.WorkerId),
+		record.Outcome,
+		record.ErrorClass,
+		record.Error,
+		strconv.Itoa(record.NumResultRows),
+		strconv.FormatInt(record.NumResultBytes, 10),
+		record.StartTime.Format(time.RFC3339Nano),
+		strconv.FormatFloat(record.StartOffsetMs, 'f', -1, 64),
+		strconv.FormatFloat(record.DurationMs, 'f', -1, 64),
+		strconv.FormatFloat(record.FirstRowMs, 'f', -1, 64),
+		strconv.FormatFloat(record.DrainMs, 'f', -1, 64),
+		strconv.FormatBool(record.Warmup),
+		strconv.FormatFloat(record.DelayMs, 'f', -1, 64),
+	}
+	for _, name := range writer.params {
+		value, ok := record.Params[name]
+		if ok {
+			row = append(row, fmt.Sprint(value))
+		} else {
+			// This query's template doesn't have this param
+			row = append(row, "")
+		}
+	}
+	return writer.csv.Write(row)
+}
+
+// Close flushes any buffered records and closes the file
+func (writer *RawWriter) Close() error {
+	if writer.csv != nil {
+		writer.csv.Flush()
+		if err := writer.csv.Error(); err != nil {
+			writer.file.Close()
+			return err
+		}
+	}
+	return writer.file.Close()
+}
+
+// formatParams returns the args by the names of the template params
+func formatParams(template *QueryTemplate, args []interface{}) map[string]interface{} {
+	params := make(map[string]interface{}, len(args))
+	for i, param := range template.Params {
+		if i < len(args) {
+			params[param.Name] = formatParam(args[i])
+		}
+	}
+	return params
+}
+
+// formatParam formats timestamps the same way as the CSV input, other values are unchanged
+func formatParam(value interface{}) interface{} {
+	if t, ok := value.(time.Time); ok {
+		return t.Format(timeFormat)
+	}
+	return value
+}
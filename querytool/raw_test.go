@@ -0,0 +1,74 @@
+package querytool
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type nopCloser struct {
+	strings.Builder
+}
+
+func (*nopCloser) Close() error { return nil }
+
+func rawTestStats() ([]*QueryTemplate, time.Time, []QueryStats) {
+	templates := DefaultTemplates()
+	runStart := time.Date(2022, 2, 1, 12, 0, 0, 0, time.UTC)
+	args := []interface{}{
+		"host_000008",
+		time.Date(2017, 1, 1, 8, 59, 22, 0, time.UTC),
+		time.Date(2017, 1, 1, 9, 59, 22, 0, time.UTC),
+	}
+	allStats := []QueryStats{
+		{
+			WorkerId: 1, NumResultRows: 60, NumResultBytes: 2400, Duration: 2500 * time.Microsecond, Host: "host_000008",
+			TimeToFirstRow: 2 * time.Millisecond, DrainTime: 500 * time.Microsecond,
+			Query: "cpu_stats", Args: args, Start: runStart.Add(10 * time.Millisecond),
+		},
+		{
+			WorkerId: 2, Duration: time.Millisecond, Host: "host_000008",
+			Query: "cpu_stats", Args: args, Start: runStart.Add(20 * time.Millisecond),
+			Err: &QueryError{Class: ConnectionError, Err: errors.New("connection refused")}, Warmup: true,
+		},
+	}
+	return templates, runStart, allStats
+}
+
+func TestRawWriterCSV(t *testing.T) {
+	expected := `query,host,worker,outcome,error_class,error,rows,bytes,start_time,start_offset_ms,duration_ms,first_row_ms,drain_ms,warmup,delay_ms,param_hostname,param_start_time,param_end_time
+cpu_stats,host_000008,1,succeeded,,,60,2400,2022-02-01T12:00:00.01Z,10,2.5,2,0.5,false,0,host_000008,2017-01-01 08:59:22,2017-01-01 09:59:22
+cpu_stats,host_000008,2,failed,connection,connection refused,0,0,2022-02-01T12:00:00.02Z,20,1,0,0,true,0,host_000008,2017-01-01 08:59:22,2017-01-01 09:59:22
+`
+	templates, runStart, allStats := rawTestStats()
+
+	output := &nopCloser{}
+	writer, err := newRawWriter(output, false, templates, runStart)
+	a := assert.New(t)
+	a.Nil(err)
+	for i := range allStats {
+		a.Nil(writer.Write(&allStats[i]))
+	}
+	a.Nil(writer.Close())
+	a.Equal(output.String(), expected)
+}
+
+func TestRawWriterJSON(t *testing.T) {
+	expected := `{"query":"cpu_stats","host":"host_000008","worker":1,"params":{"end_time":"2017-01-01 09:59:22","hostname":"host_000008","start_time":"2017-01-01 08:59:22"},"outcome":"succeeded","rows":60,"bytes":2400,"start_time":"2022-02-01T12:00:00.01Z","start_offset_ms":10,"duration_ms":2.5,"first_row_ms":2,"drain_ms":0.5,"warmup":false,"delay_ms":0}
+{"query":"cpu_stats","host":"host_000008","worker":2,"params":{"end_time":"2017-01-01 09:59:22","hostname":"host_000008","start_time":"2017-01-01 08:59:22"},"outcome":"failed","error_class":"connection","error":"connection refused","rows":0,"bytes":0,"start_time":"2022-02-01T12:00:00.02Z","start_offset_ms":20,"duration_ms":1,"first_row_ms":0,"drain_ms":0,"warmup":true,"delay_ms":0}
+`
+	templates, runStart, allStats := rawTestStats()
+
+	output := &nopCloser{}
+	writer, err := newRawWriter(output, true, templates, runStart)
+	a := assert.New(t)
+	a.Nil(err)
+	for i := range allStats {
+		a.Nil(writer.Write(&allStats[i]))
+	}
+	a.Nil(writer.Close())
+	a.Equal(output.String(), expected)
+}
@@ -0,0 +1,201 @@
+package querytool
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// referenceData is the cpu_usage table, loaded from the CSV file the database was loaded from,
+// for computing the expected results of the cpu_stats query in Go, see referenceData.results
+type referenceData struct {
+	// byHost has the usage of each host sorted by time
+	byHost map[string][]usageRow
+}
+
+type usageRow struct {
+	ts    time.Time
+	usage float64
+}
+
+// The timestamp formats accepted in the reference data, the first is how data/cpu_usage.csv is formatted.
+// Timestamps without a timezone are UTC, like the database's default TimeZone, see parseValue.
+var referenceTimeFormats = []string{timeFormat, "2006-01-02 15:04:05.999999999-07", time.RFC3339Nano}
+
+// loadReferenceData reads the cpu_usage CSV, which must have a header row naming the ts, host and usage columns
+func loadReferenceData(reader io.Reader) (*referenceData, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.ReuseRecord = true
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %w", err)
+	}
+	columns := map[string]int{"ts": -1, "host": -1, "usage": -1}
+	for i, name := range header {
+		if _, ok := columns[name]; ok {
+			columns[name] = i
+		}
+	}
+	for name, i := range columns {
+		if i < 0 {
+			return nil, fmt.Errorf("the CSV header has no %s column", name)
+		}
+	}
+
+	data := &referenceData{byHost: make(map[string][]usageRow)}
+	for line := 2; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV: %w", err)
+		}
+
+		row := usageRow{}
+		row.ts, err = parseReferenceTime(record[columns["ts"]])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		row.usage, err = strconv.ParseFloat(record[columns["usage"]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: usage must be a number, not %s", line, record[columns["usage"]])
+		}
+		host := record[columns["host"]]
+		data.byHost[host] = append(data.byHost[host], row)
+	}
+
+	for _, rows := range data.byHost {
+		sort.Slice(rows, func(i, j int) bool { return rows[i].ts.Before(rows[j].ts) })
+	}
+	return data, nil
+}
+
+func parseReferenceTime(value string) (time.Time, error) {
+	for _, format := range referenceTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("ts must be formatted like %s, not %s", timeFormat, value)
+}
+
+// timeBucketOrigin is where time_bucket starts the buckets by default, a Monday,
+// so that week buckets start on Mondays
+var timeBucketOrigin = time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC)
+
+// results computes the expected rows of the query, if it's a variant of the built-in cpu_stats
+// query (see cpuStatsQuery) rather than a template from a file, and its aggregates are min, max, avg, sum or count of u.usage.
+// It returns false if it can't compute them.
+func (data *referenceData) results(query *Query) ([][]interface{}, bool) {
+	if !query.Template.builtin || len(query.Args) != 3 {
+		return nil, false
+	}
+	host, ok1 := query.Args[0].(string)
+	start, ok2 := query.Args[1].(time.Time)
+	end, ok3 := query.Args[2].(time.Time)
+	width, ok4 := parseBucketWidth(query.Template.bucket)
+	aggregates, ok5 := parseAggregates(query.Template.aggregates)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 {
+		return nil, false
+	}
+
+	type bucket struct {
+		start           time.Time
+		min, max, total float64
+		count           int
+	}
+	var buckets []*bucket
+	rows := data.byHost[host]
+	first := sort.Search(len(rows), func(i int) bool { return !rows[i].ts.Before(start) })
+	// BETWEEN includes the end time
+	for _, row := range rows[first:] {
+		if row.ts.After(end) {
+			break
+		}
+		offset := row.ts.Sub(timeBucketOrigin)
+		bucketStart := timeBucketOrigin.Add(offset - offset%width)
+		if offset%width < 0 {
+			bucketStart = bucketStart.Add(-width)
+		}
+		// The rows are sorted by time, so the buckets are too
+		if len(buckets) == 0 || !buckets[len(buckets)-1].start.Equal(bucketStart) {
+			buckets = append(buckets, &bucket{start: bucketStart, min: row.usage, max: row.usage})
+		}
+		b := buckets[len(buckets)-1]
+		b.min = math.Min(b.min, row.usage)
+		b.max = math.Max(b.max, row.usage)
+		b.total += row.usage
+		b.count++
+	}
+
+	// ORDER BY bucket DESC
+	results := make([][]interface{}, 0, len(buckets))
+	for i := len(buckets) - 1; i >= 0; i-- {
+		b := buckets[i]
+		row := []interface{}{resultValue(b.start)}
+		for _, aggregate := range aggregates {
+			switch aggregate {
+			case "min":
+				row = append(row, b.min)
+			case "max":
+				row = append(row, b.max)
+			case "avg":
+				row = append(row, b.total/float64(b.count))
+			case "sum":
+				row = append(row, b.total)
+			case "count":
+				row = append(row, float64(b.count))
+			}
+		}
+		results = append(results, row)
+	}
+	return results, true
+}
+
+var bucketWidthPattern = regexp.MustCompile(`^\s*(\d+)\s*([a-z]+)\s*$`)
+
+var bucketUnits = map[string]time.Duration{
+	"second": time.Second, "seconds": time.Second, "sec": time.Second, "secs": time.Second, "s": time.Second,
+	"minute": time.Minute, "minutes": time.Minute, "min": time.Minute, "mins": time.Minute, "m": time.Minute,
+	"hour": time.Hour, "hours": time.Hour, "h": time.Hour,
+	"day": 24 * time.Hour, "days": 24 * time.Hour, "d": 24 * time.Hour,
+	"week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour, "w": 7 * 24 * time.Hour,
+}
+
+// parseBucketWidth parses a time_bucket width like 5 minutes. Months and years
+// aren't a fixed duration, and intervals with several units aren't supported.
+func parseBucketWidth(width string) (time.Duration, bool) {
+	match := bucketWidthPattern.FindStringSubmatch(strings.ToLower(width))
+	if match == nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(match[1])
+	unit, ok := bucketUnits[match[2]]
+	if err != nil || !ok || n <= 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+var aggregatePattern = regexp.MustCompile(`^(min|max|avg|sum|count)\(\s*(u\.)?usage\s*\)$|^count\(\s*\*\s*\)$`)
+
+// parseAggregates parses a list of aggregates like min(u.usage), max(u.usage)
+// returning the functions, like min and max
+func parseAggregates(aggregates string) ([]string, bool) {
+	var functions []string
+	for _, aggregate := range strings.Split(aggregates, ",") {
+		aggregate = strings.ToLower(strings.TrimSpace(aggregate))
+		if !aggregatePattern.MatchString(aggregate) {
+			return nil, false
+		}
+		functions = append(functions, aggregate[:strings.Index(aggregate, "(")])
+	}
+	return functions, true
+}
@@ -0,0 +1,116 @@
+package querytool
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testReferenceData = `ts,host,usage
+2017-01-01 09:00:10,host_1,10
+2017-01-01 09:00:50,host_1,30
+2017-01-01 09:01:00,host_1,5
+2017-01-01 08:59:59,host_1,99
+2017-01-01 09:02:00,host_1,7
+2017-01-01 09:00:30,host_2,50
+`
+
+func TestReferenceResults(t *testing.T) {
+	a := assert.New(t)
+	data, err := loadReferenceData(strings.NewReader(testReferenceData))
+	a.Nil(err)
+
+	variants, err := expandVariants(DefaultTemplates(), []string{"1 minute", "2 minutes"},
+		[]string{"min(u.usage), max(u.usage)", "avg(u.usage), count(*)", "stddev(u.usage)"})
+	a.Nil(err)
+	query := func(variant int, host string) *Query {
+		// 08:59:59 is before the start, and BETWEEN includes the end at 09:02:00
+		args := []interface{}{
+			host, time.Date(2017, 1, 1, 9, 0, 0, 0, time.UTC), time.Date(2017, 1, 1, 9, 2, 0, 0, time.UTC),
+		}
+		return &Query{Template: variants[variant], Host: host, Args: args}
+	}
+
+	tests := []struct {
+		query    *Query
+		expected [][]interface{}
+	}{
+		{
+			query: query(0, "host_1"),
+			expected: [][]interface{}{
+				{"2017-01-01T09:02:00Z", 7.0, 7.0},
+				{"2017-01-01T09:01:00Z", 5.0, 5.0},
+				{"2017-01-01T09:00:00Z", 10.0, 30.0},
+			},
+		},
+		{
+			query: query(1, "host_1"),
+			expected: [][]interface{}{
+				{"2017-01-01T09:02:00Z", 7.0, 1.0},
+				{"2017-01-01T09:01:00Z", 5.0, 1.0},
+				{"2017-01-01T09:00:00Z", 20.0, 2.0},
+			},
+		},
+		{
+			// The buckets start from 2000-01-03, an even number of minutes
+			query: query(4, "host_1"),
+			expected: [][]interface{}{
+				{"2017-01-01T09:02:00Z", 7.0, 1.0},
+				{"2017-01-01T09:00:00Z", 15.0, 3.0},
+			},
+		},
+		{
+			query:    query(1, "host_2"),
+			expected: [][]interface{}{{"2017-01-01T09:00:00Z", 50.0, 1.0}},
+		},
+		{
+			query:    query(0, "host_3"),
+			expected: [][]interface{}{},
+		},
+		// stddev isn't supported
+		{
+			query:    query(2, "host_1"),
+			expected: nil,
+		},
+	}
+
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		results, ok := data.results(test.query)
+		a.Equal(ok, test.expected != nil)
+		a.Equal(results, test.expected)
+	}
+
+	// A template from a file isn't the built-in query, even with the same name
+	custom := *variants[0]
+	custom.builtin = false
+	_, ok := data.results(&Query{Template: &custom, Host: "host_1", Args: query(0, "host_1").Args})
+	a.False(ok)
+
+	_, err = loadReferenceData(strings.NewReader("time,host,usage\n"))
+	a.EqualError(err, "the CSV header has no ts column")
+}
+
+func TestParseBucketWidth(t *testing.T) {
+	tests := []struct {
+		width    string
+		expected time.Duration
+	}{
+		{width: "1 minute", expected: time.Minute},
+		{width: "10 seconds", expected: 10 * time.Second},
+		{width: "2 Hours", expected: 2 * time.Hour},
+		{width: "1 day", expected: 24 * time.Hour},
+		{width: "1 month"},
+		{width: "1 hour 30 minutes"},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		width, ok := parseBucketWidth(test.width)
+		a.Equal(ok, test.expected != 0)
+		a.Equal(width, test.expected)
+	}
+}
@@ -0,0 +1,905 @@
+package querytool
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The supported output formats for the Report
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+	CSVFormat  = "csv"
+)
+
+// Report is the result of a benchmark run. The JSON and CSV formats are
+// a stable schema for archiving and diffing benchmark results, so fields
+// can be added to it, but never renamed or removed.
+type Report struct {
+	Timestamp  time.Time `json:"timestamp"` // when the run started
+	Target     string    `json:"target"`    // the connection string, without the password
+	Workers    int       `json:"workers"`
+	ConnMode   string    `json:"conn_mode"` // pool or dedicated, see Options.ConnMode
+	Driver     string    `json:"driver"`    // pq or pgx
+	Protocol   string    `json:"protocol"`  // extended, prepared or simple
+	WallTimeMs float64   `json:"wall_time_ms"`
+	// Speedup is the total time spent running queries divided by the wall time
+	Speedup   float64 `json:"speedup"`
+	Queries   int     `json:"queries"`
+	Succeeded int     `json:"succeeded"`
+	Failed    int     `json:"failed"`
+	TimedOut  int     `json:"timed_out"`
+	// QueryTimeoutMs is the per query timeout, 0 if there wasn't one
+	QueryTimeoutMs float64 `json:"query_timeout_ms"`
+	// TargetQPS is the rate queries were sent at in the open-loop mode, 0 in the closed-loop mode
+	TargetQPS   float64 `json:"target_qps"`
+	Arrivals    string  `json:"arrivals,omitempty"` // constant or poisson, in the open-loop mode
+	AchievedQPS float64 `json:"achieved_qps"`
+	// ActiveQPS is the throughput from the first query starting to the last one completing, see Results.ActiveQPS
+	ActiveQPS float64 `json:"active_qps"`
+	// AverageDelayMs and MaxDelayMs are how late the queries were sent compared to
+	// their schedule in the open-loop mode, because all the workers were busy
+	AverageDelayMs float64 `json:"average_send_delay_ms"`
+	MaxDelayMs     float64 `json:"max_send_delay_ms"`
+	// Rows and Bytes are the total rows and approximate bytes returned by the successful
+	// queries, the bytes are the size of the values as sent by the server
+	Rows        int64   `json:"rows"`
+	Bytes       int64   `json:"bytes"`
+	RowsPerSec  float64 `json:"rows_per_second"`
+	BytesPerSec float64 `json:"bytes_per_second"`
+	// FirstRow and Drain are the time until the first row was received and the time
+	// to fetch the rest, for the successful queries. They're nil if no queries succeeded.
+	FirstRow *SummaryStats `json:"time_to_first_row"`
+	Drain    *SummaryStats `json:"drain_time"`
+	// Percentiles are the percentiles calculated in the SummaryStats
+	Percentiles []float64     `json:"percentiles"`
+	Errors      []ErrorCount  `json:"errors"`
+	Summary     *SummaryStats `json:"summary"` // nil if no queries succeeded
+	// ByQuery has a summary for each query template (variant) in the order they were run
+	ByQuery []QueryReport `json:"by_query"`
+	// Pool has the connection pool stats, it's nil if they're not available
+	Pool *PoolReport `json:"pool"`
+	// Warmup summarizes the queries in the warmup phase, which are excluded from the
+	// rest of the report, including the WallTimeMs. It's nil if there was no warmup.
+	Warmup *WarmupReport `json:"warmup"`
+	// Verification is the outcome of checking the result rows, it's nil if they weren't checked
+	Verification *VerificationReport `json:"verification"`
+	// Slowest are the slowest queries run again with EXPLAIN ANALYZE, without their plans,
+	// which are in the ExplainFile. It's empty unless Options.ExplainSlowest is set.
+	Slowest     []ExplainedQuery `json:"slowest,omitempty"`
+	ExplainFile string           `json:"explain_file,omitempty"`
+	// ByHost and ByWorker summarize the successful queries of each host (sorted by name) and
+	// each worker, and SlowestHosts are the Options.TopHosts hosts with the highest median,
+	// to spot hot hosts or a skewed chunk layout. They're empty unless Options.Breakdown is set.
+	ByHost       []BreakdownReport `json:"by_host,omitempty"`
+	ByWorker     []BreakdownReport `json:"by_worker,omitempty"`
+	SlowestHosts []BreakdownReport `json:"slowest_hosts,omitempty"`
+	// Baseline compares the run with the Options.BaselinePath, it's nil if there's no baseline
+	Baseline *BaselineReport `json:"baseline,omitempty"`
+	// Intervals are the stats for each Options.Interval of the run, including the warmup phase.
+	// They have the p50, p95 and p99 regardless of the Percentiles.
+	Intervals []IntervalReport `json:"intervals,omitempty"`
+	// Histogram is the distribution of the successful query durations, it has
+	// the non-empty buckets of the Histogram, which are within 0.1% of the values.
+	Histogram []HistogramBin `json:"histogram"`
+
+	// showHistogram includes the latency distribution in the text format
+	showHistogram bool
+}
+
+// PoolReport is the part of the Report for the connection pool, for the whole run including the warmup.
+// The time spent waiting for a connection (because of the max open connections) is
+// included in the query durations, this shows how much of them it accounts for.
+type PoolReport struct {
+	MaxOpen           int     `json:"max_open"` // 0 for no limit
+	Open              int     `json:"open"`     // at the end of the run
+	WaitCount         int64   `json:"wait_count"`
+	WaitMs            float64 `json:"wait_ms"`
+	MaxIdleClosed     int64   `json:"max_idle_closed"`
+	MaxLifetimeClosed int64   `json:"max_lifetime_closed"`
+}
+
+// WarmupReport is the part of the Report for the warmup phase
+type WarmupReport struct {
+	WallTimeMs float64       `json:"wall_time_ms"`
+	Queries    int           `json:"queries"`
+	Succeeded  int           `json:"succeeded"`
+	Failed     int           `json:"failed"`
+	TimedOut   int           `json:"timed_out"`
+	Summary    *SummaryStats `json:"summary"` // nil if no queries succeeded
+}
+
+// VerificationReport is the part of the Report for the queries whose results were checked, see Verifier
+type VerificationReport struct {
+	Checked    int `json:"checked"`
+	Mismatched int `json:"mismatched"`
+	// Unchecked are the successful queries there were no expected results for
+	Unchecked int `json:"unchecked"`
+	// Mismatches are the first few queries that returned the wrong results
+	Mismatches []Mismatch `json:"mismatches"`
+}
+
+// BreakdownReport is the part of the Report for the queries of a host or a worker
+type BreakdownReport struct {
+	Host    string        `json:"host,omitempty"`
+	Worker  int           `json:"worker,omitempty"`
+	Queries int64         `json:"queries"`
+	Summary *SummaryStats `json:"summary"`
+}
+
+// HistogramBin is the number of queries with a duration of about Ms milliseconds
+type HistogramBin struct {
+	Ms    float64 `json:"ms"`
+	Count int64   `json:"count"`
+}
+
+// ErrorCount is the number of failed queries of an ErrorClass
+type ErrorCount struct {
+	Class      string `json:"class"`
+	Count      int    `json:"count"`
+	FirstError string `json:"first_error"`
+}
+
+// QueryReport is the part of the Report for a single query template (variant)
+type QueryReport struct {
+	Query     string        `json:"query"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	TimedOut  int           `json:"timed_out"`
+	Summary   *SummaryStats `json:"summary"` // nil if no queries succeeded
+	Rows      int64         `json:"rows"`
+	Bytes     int64         `json:"bytes"`
+	// AverageFirstRowMs and AverageDrainMs are the average time to first row and drain time
+	AverageFirstRowMs float64 `json:"average_first_row_ms"`
+	AverageDrainMs    float64 `json:"average_drain_ms"`
+}
+
+// PrintSummaryStats prints the summary statistics for all the queries run
+// in the format and to the file given by the options. If the run regressed from
+// the baseline (see Options.BaselinePath) it returns an error after printing them.
+func PrintSummaryStats(options *Options, totalDuration time.Duration, results *Results) error {
+	report := NewReport(options, totalDuration, results)
+
+	output := os.Stdout
+	if options.OutputFilePath != "" && options.OutputFilePath != "-" {
+		var err error
+		output, err = os.Create(options.OutputFilePath)
+		if err != nil {
+			return fmt.Errorf("PrintSummaryStats failed to create %s: %w", options.OutputFilePath, err)
+		}
+		defer output.Close()
+	}
+
+	if err := report.Write(output, options.OutputFormat); err != nil {
+		return err
+	}
+	return report.Baseline.regressionError()
+}
+
+// NewReport computes the Report for all the queries run
+func NewReport(options *Options, totalDuration time.Duration, results *Results) *Report {
+	timestamp := results.Start.UTC()
+	if results.Start.IsZero() {
+		timestamp = time.Now().Add(-totalDuration).UTC()
+	}
+	var warmup *WarmupReport
+	if results.Warmup != nil {
+		warmup = &WarmupReport{
+			WallTimeMs: millis(results.WarmupTime),
+			Queries:    results.Warmup.Queries,
+			Succeeded:  results.Warmup.Succeeded,
+			Failed:     results.Warmup.Failed,
+			TimedOut:   results.Warmup.TimedOut,
+			Summary:    summarize(results.Warmup.Histogram(), options.Percentiles),
+		}
+		// The rest of the report is for the measured phase after the warmup
+		totalDuration -= results.WarmupTime
+	}
+
+	report := &Report{
+		Timestamp:      timestamp,
+		Target:         redactConnectionString(options.DBConnectionString),
+		Workers:        options.NumWorkers,
+		ConnMode:       options.ConnMode,
+		Driver:         options.Driver,
+		Protocol:       options.Protocol,
+		WallTimeMs:     millis(totalDuration),
+		Queries:        results.Queries,
+		Succeeded:      results.Succeeded,
+		Failed:         results.Failed,
+		TimedOut:       results.TimedOut,
+		QueryTimeoutMs: millis(options.QueryTimeout),
+		TargetQPS:      options.Rate,
+		AchievedQPS:    perSecond(float64(results.Queries), totalDuration),
+		ActiveQPS:      results.ActiveQPS(),
+		Rows:           results.Rows,
+		Bytes:          results.Bytes,
+		RowsPerSec:     perSecond(float64(results.Rows), totalDuration),
+		BytesPerSec:    perSecond(float64(results.Bytes), totalDuration),
+		FirstRow:       summarize(results.FirstRow, options.Percentiles),
+		Drain:          summarize(results.Drain, options.Percentiles),
+		MaxDelayMs:     millis(results.MaxDelay),
+		Percentiles:    options.Percentiles,
+		Errors:         results.ErrorCounts(),
+		Warmup:         warmup,
+		Pool:           newPoolReport(results.Pool),
+		Histogram:      []HistogramBin{},
+		showHistogram:  options.PrintHistogram,
+	}
+
+	if verification := results.Verification; verification != nil {
+		report.Verification = &VerificationReport{
+			Checked:    verification.Checked,
+			Mismatched: verification.Mismatched,
+			Unchecked:  verification.Unchecked,
+			Mismatches: append([]Mismatch{}, verification.Mismatches...),
+		}
+	}
+	if len(results.Explained) != 0 {
+		report.ExplainFile = options.ExplainFilePath
+		for _, explained := range results.Explained {
+			explained.Plan = nil
+			report.Slowest = append(report.Slowest, explained)
+		}
+	}
+	if options.Breakdown {
+		report.addBreakdown(results, options)
+	}
+	for i := range results.Intervals {
+		report.Intervals = append(report.Intervals, newIntervalReport(&results.Intervals[i]))
+	}
+	if options.Rate > 0 {
+		report.Arrivals = options.Arrivals
+	}
+	if results.Queries != 0 {
+		report.AverageDelayMs = millis(results.TotalDelay) / float64(results.Queries)
+	}
+
+	for _, query := range results.ByQuery() {
+		queryReport := QueryReport{
+			Query:     query.Query,
+			Succeeded: query.Succeeded,
+			Failed:    query.Failed,
+			TimedOut:  query.TimedOut,
+			Summary:   summarize(query.Histogram, options.Percentiles),
+			Rows:      query.Rows,
+			Bytes:     query.Bytes,
+		}
+		if query.Succeeded != 0 {
+			queryReport.AverageFirstRowMs = millis(query.FirstRow) / float64(query.Succeeded)
+			queryReport.AverageDrainMs = millis(query.Drain) / float64(query.Succeeded)
+		}
+		report.ByQuery = append(report.ByQuery, queryReport)
+	}
+
+	histogram := results.Histogram()
+	report.Summary = summarize(histogram, options.Percentiles)
+	if report.Summary != nil {
+		report.Speedup = parallelSpeedup(report.Summary.Total, totalDuration)
+	}
+	if results.Baseline != nil {
+		report.Baseline = compareBaseline(results.Baseline, histogram, report.ActiveQPS, options.RegressionThreshold)
+	}
+	for _, bucket := range histogram.Buckets() {
+		report.Histogram = append(report.Histogram, HistogramBin{Ms: millis(bucket.Value), Count: bucket.Count})
+	}
+
+	return report
+}
+
+// addBreakdown sets ByHost, ByWorker and SlowestHosts
+func (report *Report) addBreakdown(results *Results, options *Options) {
+	for host, histogram := range results.ByHost() {
+		report.ByHost = append(report.ByHost, BreakdownReport{
+			Host: host, Queries: histogram.Count(), Summary: summarize(histogram, options.Percentiles),
+		})
+	}
+	sort.Slice(report.ByHost, func(i, j int) bool { return report.ByHost[i].Host < report.ByHost[j].Host })
+	for worker, histogram := range results.ByWorker() {
+		report.ByWorker = append(report.ByWorker, BreakdownReport{
+			Worker: worker, Queries: histogram.Count(), Summary: summarize(histogram, options.Percentiles),
+		})
+	}
+	sort.Slice(report.ByWorker, func(i, j int) bool { return report.ByWorker[i].Worker < report.ByWorker[j].Worker })
+
+	report.SlowestHosts = append([]BreakdownReport{}, report.ByHost...)
+	// ByHost is sorted by name, so hosts with the same median stay in that order
+	sort.SliceStable(report.SlowestHosts, func(i, j int) bool {
+		return report.SlowestHosts[i].Summary.Median > report.SlowestHosts[j].Summary.Median
+	})
+	if len(report.SlowestHosts) > options.TopHosts {
+		report.SlowestHosts = report.SlowestHosts[:options.TopHosts]
+	}
+	if len(report.SlowestHosts) == 0 {
+		report.SlowestHosts = nil
+	}
+}
+
+// newPoolReport returns the PoolReport for stats, or nil if stats is nil
+func newPoolReport(stats *PoolStats) *PoolReport {
+	if stats == nil {
+		return nil
+	}
+	return &PoolReport{
+		MaxOpen:           stats.MaxOpenConnections,
+		Open:              stats.OpenConnections,
+		WaitCount:         stats.WaitCount,
+		WaitMs:            millis(stats.WaitDuration),
+		MaxIdleClosed:     stats.MaxIdleClosed,
+		MaxLifetimeClosed: stats.MaxLifetimeClosed,
+	}
+}
+
+// summarize returns the SummaryStats for the histogram, or nil if it's empty
+func summarize(histogram *Histogram, percentiles []float64) *SummaryStats {
+	if histogram.Count() == 0 {
+		return nil
+	}
+	stats := histogram.Summary(percentiles)
+	return &stats
+}
+
+// parallelSpeedup is how many times faster the queries ran using multiple workers,
+// compared to running them one at a time (assuming they'd take the same time.)
+func parallelSpeedup(totalQueryDuration, wallTime time.Duration) float64 {
+	if wallTime <= 0 {
+		return 0
+	}
+	return float64(totalQueryDuration) / float64(wallTime)
+}
+
+// perSecond is the rate of count over the duration, or 0 if the benchmark didn't run,
+// e.g. because the dedicated connections couldn't be opened, since JSON can't encode NaN
+func perSecond(count float64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return count / d.Seconds()
+}
+
+var passwordPattern = regexp.MustCompile(`password\s*=\s*('(\\.|[^'])*'|\S+)`)
+
+// redactConnectionString removes the password from the connection string, so it can be shared
+func redactConnectionString(connectionString string) string {
+	if u, err := url.Parse(connectionString); err == nil && u.Scheme != "" {
+		query := u.Query()
+		if query.Get("password") != "" {
+			query.Set("password", "xxxxx")
+			u.RawQuery = query.Encode()
+		}
+		return u.Redacted()
+	}
+	return passwordPattern.ReplaceAllString(connectionString, "password=xxxxx")
+}
+
+// Write writes the report to w in the given format (text, json or csv)
+func (report *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case JSONFormat:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case CSVFormat:
+		return report.writeCSV(w)
+	case TextFormat, "":
+		return report.writeText(w)
+	default:
+		return fmt.Errorf("unknown output format %s", format)
+	}
+}
+
+// percentileName formats the percentile for the JSON and CSV output, like p99.9
+func percentileName(percentile float64) string {
+	return "p" + strconv.FormatFloat(percentile, 'f', -1, 64)
+}
+
+// percentileOrdinal formats the percentile for the text output, like 99.9th or 1st
+func percentileOrdinal(percentile float64) string {
+	suffix := "th"
+	if percentile == math.Trunc(percentile) {
+		n := int(percentile)
+		switch {
+		case n%100 >= 11 && n%100 <= 13:
+		case n%10 == 1:
+			suffix = "st"
+		case n%10 == 2:
+			suffix = "nd"
+		case n%10 == 3:
+			suffix = "rd"
+		}
+	}
+	return strconv.FormatFloat(percentile, 'f', -1, 64) + suffix
+}
+
+// MarshalJSON writes the SummaryStats with the durations in milliseconds
+// and the percentiles as an object like {"p95": 12.5, "p99": 20.1}
+func (stats SummaryStats) MarshalJSON() ([]byte, error) {
+	percentiles := make(map[string]float64, len(stats.Percentiles))
+	for _, p := range stats.Percentiles {
+		percentiles[percentileName(p.Percentile)] = millis(p.Value)
+	}
+
+	return json.Marshal(struct {
+		MinMs       float64            `json:"min_ms"`
+		MaxMs       float64            `json:"max_ms"`
+		AverageMs   float64            `json:"average_ms"`
+		MedianMs    float64            `json:"median_ms"`
+		Percentiles map[string]float64 `json:"percentiles_ms"`
+		StdDevMs    float64            `json:"stddev_ms"`
+		TotalMs     float64            `json:"total_ms"`
+	}{
+		MinMs:       millis(stats.Min),
+		MaxMs:       millis(stats.Max),
+		AverageMs:   millis(stats.Average),
+		MedianMs:    millis(stats.Median),
+		Percentiles: percentiles,
+		StdDevMs:    stats.StdDev,
+		TotalMs:     millis(stats.Total),
+	})
+}
+
+var csvHeader = []string{
+	"timestamp", "target", "workers", "conn_mode", "driver", "protocol", "wall_time_ms", "speedup", "query",
+	"queries", "succeeded", "failed", "timed_out",
+	"min_ms", "max_ms", "average_ms", "median_ms", "stddev_ms", "total_ms",
+	"rows", "bytes", "average_first_row_ms", "average_drain_ms",
+}
+
+// writeCSV writes a header and a row for all the queries, named "all",
+// followed by a row for each query template (variant.)
+// The header ends with a column for each percentile, like p99.9_ms
+func (report *Report) writeCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeaderWithPercentiles(report.Percentiles)); err != nil {
+		return err
+	}
+	if err := report.writeCSVRows(writer, true); err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// csvHeaderWithPercentiles returns the CSV header with a column for each of the percentiles
+func csvHeaderWithPercentiles(percentiles []float64) []string {
+	header := append([]string{}, csvHeader...)
+	for _, percentile := range percentiles {
+		header = append(header, percentileName(percentile)+"_ms")
+	}
+	return header
+}
+
+// writeCSVRows writes the row for all the queries and, if byQuery is true, the rows for each query
+func (report *Report) writeCSVRows(writer *csv.Writer, byQuery bool) error {
+	numColumns := len(csvHeader) + len(report.Percentiles)
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	writeRow := func(query *QueryReport) error {
+		row := []string{
+			report.Timestamp.Format(time.RFC3339),
+			report.Target,
+			strconv.Itoa(report.Workers),
+			report.ConnMode,
+			report.Driver,
+			report.Protocol,
+			formatFloat(report.WallTimeMs),
+			formatFloat(report.Speedup),
+			query.Query,
+			strconv.Itoa(query.Succeeded + query.Failed + query.TimedOut),
+			strconv.Itoa(query.Succeeded),
+			strconv.Itoa(query.Failed),
+			strconv.Itoa(query.TimedOut),
+		}
+		if stats := query.Summary; stats != nil {
+			row = append(row,
+				formatFloat(millis(stats.Min)),
+				formatFloat(millis(stats.Max)),
+				formatFloat(millis(stats.Average)),
+				formatFloat(millis(stats.Median)),
+				formatFloat(stats.StdDev),
+				formatFloat(millis(stats.Total)),
+				strconv.FormatInt(query.Rows, 10),
+				strconv.FormatInt(query.Bytes, 10),
+				formatFloat(query.AverageFirstRowMs),
+				formatFloat(query.AverageDrainMs),
+			)
+			for _, p := range stats.Percentiles {
+				row = append(row, formatFloat(millis(p.Value)))
+			}
+		} else {
+			// No queries succeeded, so there are no stats
+			row = append(row, make([]string, numColumns-len(row))...)
+		}
+		return writer.Write(row)
+	}
+
+	all := QueryReport{
+		Query:     "all",
+		Succeeded: report.Succeeded,
+		Failed:    report.Failed,
+		TimedOut:  report.TimedOut,
+		Summary:   report.Summary,
+		Rows:      report.Rows,
+		Bytes:     report.Bytes,
+	}
+	if report.FirstRow != nil {
+		all.AverageFirstRowMs = millis(report.FirstRow.Average)
+		all.AverageDrainMs = millis(report.Drain.Average)
+	}
+	if err := writeRow(&all); err != nil {
+		return err
+	}
+	if !byQuery {
+		return nil
+	}
+	for i := range report.ByQuery {
+		if err := writeRow(&report.ByQuery[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (report *Report) writeText(w io.Writer) error {
+	// I asked about the purpose of this program and who the users might be.
+	// I was told not to worry about it. So I'm very much guessing here what
+	// summary statistics might be interesting to the user.
+	//
+	// Since it's a benchmark program, I output some stats about
+	// how long it took, how many queries were executed, what
+	// parallel speedup was acheived by using the specified number of workers.
+	//
+	// Since the requirements specify a min, max, median, and average
+	// value, I add the 95th percentile and standard deviation as those
+	// may also be interesting to the user.
+
+	if warmup := report.Warmup; warmup != nil {
+		fmt.Fprintf(w, "Warmup: %d queries in %.2f seconds (%d failed, %d timed out) are excluded from the stats below",
+			warmup.Queries, warmup.WallTimeMs/1000, warmup.Failed, warmup.TimedOut)
+		if warmup.Summary != nil {
+			fmt.Fprintf(w, ", their median was %.2fms and max %.2fms",
+				millis(warmup.Summary.Median), millis(warmup.Summary.Max))
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Print how many queries we executed and the "walltime" elapsed
+	fmt.Fprintf(w, "Executed %d queries in %.2f seconds\n", report.Queries, report.WallTimeMs/1000)
+	if report.TargetQPS > 0 {
+		// In the open-loop mode the durations include the time the queries waited for a free worker
+		fmt.Fprintf(w, "Sent %.1f queries/second with %s arrivals (target %v), up to %.2fms late (%.2fms on average)\n",
+			report.AchievedQPS, report.Arrivals, report.TargetQPS, report.MaxDelayMs, report.AverageDelayMs)
+	}
+	if report.TimedOut != 0 {
+		// Timed out queries are excluded from the latency stats below,
+		// they would otherwise all be recorded as the timeout value.
+		fmt.Fprintf(w, "%d queries timed out", report.TimedOut)
+		if report.QueryTimeoutMs != 0 {
+			// Without a timeout it was the network or the driver that timed out
+			fmt.Fprintf(w, " after %vms", report.QueryTimeoutMs)
+		}
+		fmt.Fprintf(w, " (%.2f%% of queries)\n", 100*float64(report.TimedOut)/float64(report.Queries))
+	}
+	if report.Failed != 0 {
+		fmt.Fprintf(w, "%d queries failed:\n", report.Failed)
+		for _, count := range report.Errors {
+			fmt.Fprintf(w, "  %s errors = %d (first error: %s)\n", count.Class, count.Count, count.FirstError)
+		}
+	}
+
+	if verification := report.Verification; verification != nil {
+		fmt.Fprintf(w, "Verified the results of %d queries, %d were wrong", verification.Checked, verification.Mismatched)
+		if verification.Unchecked != 0 {
+			fmt.Fprintf(w, " (%d couldn't be checked, there were no expected results for them)", verification.Unchecked)
+		}
+		fmt.Fprintln(w)
+		for _, mismatch := range verification.Mismatches {
+			fmt.Fprintf(w, "  %s for host %s: %s\n", mismatch.Query, mismatch.Host, mismatch.Reason)
+		}
+		if more := verification.Mismatched - len(verification.Mismatches); more > 0 {
+			fmt.Fprintf(w, "  and %d more\n", more)
+		}
+	}
+
+	stats := report.Summary
+	if stats == nil {
+		if _, err := fmt.Fprintln(w, "No queries completed successfully"); err != nil {
+			return err
+		}
+		return report.writeBaseline(w)
+	}
+
+	fmt.Fprintf(w, "Total execution time for all queries was %.2f seconds, using %d worker threads. Parallel speedup of %.1fx\n",
+		float64(stats.Total)/float64(time.Second), report.Workers, report.Speedup)
+	if report.Driver == PGXDriver || (report.Protocol != ExtendedProtocol && report.Protocol != "") {
+		fmt.Fprintf(w, "The queries were run with the %s driver using the %s protocol\n", report.Driver, report.Protocol)
+	}
+	fmt.Fprintf(w, `
+min query duration = %.2fms
+max query duration = %.2fms
+average = %.2fms
+median = %.2fms
+`,
+		float64(stats.Min)/float64(time.Millisecond),
+		float64(stats.Max)/float64(time.Millisecond),
+		float64(stats.Average)/float64(time.Millisecond),
+		float64(stats.Median)/float64(time.Millisecond),
+	)
+	for _, p := range stats.Percentiles {
+		fmt.Fprintf(w, "%s percentile = %.2fms\n", percentileOrdinal(p.Percentile), millis(p.Value))
+	}
+	_, err := fmt.Fprintf(w, "standard deviation = %.2fms\ntotal query duration = %.2fms\n",
+		stats.StdDev,
+		float64(stats.Total)/float64(time.Millisecond),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Queries returning a lot of rows can be limited by the bandwidth rather than the database,
+	// which shows up as a long time draining the rows compared to the time to the first row
+	fmt.Fprintf(w, "\nReturned %d rows (%.1f rows/second) and %s (%s/second), %.1f rows and %s per query on average\n",
+		report.Rows, report.RowsPerSec, formatBytes(float64(report.Bytes)), formatBytes(report.BytesPerSec),
+		float64(report.Rows)/float64(report.Succeeded), formatBytes(float64(report.Bytes)/float64(report.Succeeded)))
+	fmt.Fprintf(w, "time to first row: median %.2fms, average %.2fms, max %.2fms\n",
+		millis(report.FirstRow.Median), millis(report.FirstRow.Average), millis(report.FirstRow.Max))
+	fmt.Fprintf(w, "time to drain the rows: median %.2fms, average %.2fms, max %.2fms (%.1f%% of the total query duration)\n",
+		millis(report.Drain.Median), millis(report.Drain.Average), millis(report.Drain.Max),
+		100*float64(report.Drain.Total)/float64(stats.Total))
+
+	if pool := report.Pool; pool != nil {
+		fmt.Fprintf(w, "\n%d database connections open at the end", pool.Open)
+		if pool.MaxOpen > 0 {
+			fmt.Fprintf(w, " (max %d)", pool.MaxOpen)
+		}
+		if pool.MaxIdleClosed != 0 || pool.MaxLifetimeClosed != 0 {
+			fmt.Fprintf(w, ", %d closed because of the max idle connections and %d because of their max lifetime",
+				pool.MaxIdleClosed, pool.MaxLifetimeClosed)
+		}
+		fmt.Fprintln(w)
+		if pool.WaitCount != 0 {
+			// The wait is part of the query durations, so show how much of the total time it was
+			fmt.Fprintf(w, "queries waited for a free connection %d times for %.2fms in total, %.1f%% of the total query duration\n",
+				pool.WaitCount, pool.WaitMs, 100*pool.WaitMs/millis(stats.Total))
+		}
+	}
+
+	if len(report.ByQuery) > 1 {
+		if err := report.writeQueryTable(w); err != nil {
+			return err
+		}
+	}
+	if len(report.Slowest) != 0 {
+		if err := report.writeSlowestTable(w); err != nil {
+			return err
+		}
+	}
+	if len(report.SlowestHosts) != 0 {
+		title := fmt.Sprintf("The %d slowest hosts by median", len(report.SlowestHosts))
+		if err := report.writeBreakdownTable(w, title, "host", report.SlowestHosts); err != nil {
+			return err
+		}
+	}
+	if len(report.ByWorker) != 0 {
+		if err := report.writeBreakdownTable(w, "Per worker stats", "worker", report.ByWorker); err != nil {
+			return err
+		}
+	}
+	if len(report.ByHost) != 0 {
+		if err := report.writeBreakdownTable(w, "Per host stats", "host", report.ByHost); err != nil {
+			return err
+		}
+	}
+	if len(report.Intervals) != 0 {
+		if err := report.writeIntervalTable(w); err != nil {
+			return err
+		}
+	}
+	if report.showHistogram {
+		if err := report.writeDistribution(w); err != nil {
+			return err
+		}
+	}
+	// The comparison with the baseline is last, since it decides whether the run passed
+	return report.writeBaseline(w)
+}
+
+// writeBaseline writes a table comparing the run with the baseline, if there is one
+func (report *Report) writeBaseline(w io.Writer) error {
+	baseline := report.Baseline
+	if baseline == nil {
+		return nil
+	}
+	fmt.Fprintf(w, "\nCompared with the baseline %s (regression threshold %v%%):\n", baseline.Path, baseline.ThresholdPercent)
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "metric\tbaseline\tcurrent\tchange\t")
+	for _, metric := range baseline.Metrics {
+		fmt.Fprintf(writer, "%s\t%.2f\t%.2f\t%+.1f%%\t", metric.Name, metric.Baseline, metric.Current, metric.ChangePercent)
+		if metric.Regressed {
+			// Not in a column, so the rows without it don't end in spaces
+			fmt.Fprint(writer, "  REGRESSED")
+		}
+		fmt.Fprintln(writer)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	significance := "not significantly slower"
+	if baseline.Significant {
+		significance = "significantly slower"
+	}
+	_, err := fmt.Fprintf(w, "The query durations are %s than the baseline (Mann-Whitney U test p=%.3g, "+
+		"a query is slower than a baseline query %.1f%% of the time)\n",
+		significance, baseline.PValue, 100*baseline.SlowerProbability)
+	return err
+}
+
+// writeSlowestTable writes a table of the slowest queries, and what EXPLAIN ANALYZE found when they were run again
+func (report *Report) writeSlowestTable(w io.Writer) error {
+	fmt.Fprintf(w, "\nSlowest queries, run again with EXPLAIN ANALYZE (plans in %s):\n", report.ExplainFile)
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "query\thost\tms\texplain ms\tplanning ms\tchunks\tbuffers hit\tbuffers read\t")
+	for _, query := range report.Slowest {
+		fmt.Fprintf(writer, "%s\t%s\t%.2f\t", query.Query, query.Host, query.DurationMs)
+		if query.Error != "" {
+			// The error isn't in a column, so it doesn't widen the rest of them
+			fmt.Fprintf(writer, "  error: %s\n", query.Error)
+			continue
+		}
+		fmt.Fprintf(writer, "%.2f\t%.2f\t%d\t%d\t%d\t\n", query.ExecutionMs, query.PlanningMs,
+			query.Chunks, query.SharedHitBlocks, query.SharedReadBlocks)
+	}
+	return writer.Flush()
+}
+
+// writeBreakdownTable writes a table of the summary statistics for each host or worker, with how their
+// median compares to the overall median, so the outliers stand out
+func (report *Report) writeBreakdownTable(w io.Writer, title, column string, rows []BreakdownReport) error {
+	fmt.Fprintf(w, "\n%s (ms):\n", title)
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "%s\tcount\tmin\tmedian\t", column)
+	for _, percentile := range report.Percentiles {
+		fmt.Fprintf(writer, "%s\t", percentileOrdinal(percentile))
+	}
+	fmt.Fprintln(writer, "max\tvs median\t")
+
+	for _, row := range rows {
+		name := row.Host
+		if column == "worker" {
+			name = strconv.Itoa(row.Worker)
+		}
+		stats := row.Summary
+		fmt.Fprintf(writer, "%s\t%d\t%.2f\t%.2f\t", name, row.Queries, millis(stats.Min), millis(stats.Median))
+		for _, p := range stats.Percentiles {
+			fmt.Fprintf(writer, "%.2f\t", millis(p.Value))
+		}
+		fmt.Fprintf(writer, "%.2f\t%.2fx\t\n", millis(stats.Max), float64(stats.Median)/float64(report.Summary.Median))
+	}
+	return writer.Flush()
+}
+
+// writeIntervalTable writes a table of the throughput and latency in each interval of the run
+func (report *Report) writeIntervalTable(w io.Writer) error {
+	fmt.Fprintf(w, "\nPer interval stats (ms):\n")
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(writer, "end (s)\tqueries\tqueries/second\tfailed\ttimed out\t")
+	for _, percentile := range intervalPercentiles {
+		fmt.Fprintf(writer, "%s\t", percentileOrdinal(percentile))
+	}
+	fmt.Fprintln(writer, "max\t")
+
+	for _, interval := range report.Intervals {
+		fmt.Fprintf(writer, "%.1f\t%d\t%.1f\t%d\t%d\t", interval.EndS, interval.Queries, interval.QPS,
+			interval.Failed, interval.TimedOut)
+		stats := interval.Summary
+		if stats == nil {
+			fmt.Fprintln(writer, strings.Repeat("-\t", len(intervalPercentiles)+1))
+			continue
+		}
+		for _, p := range stats.Percentiles {
+			fmt.Fprintf(writer, "%.2f\t", millis(p.Value))
+		}
+		fmt.Fprintf(writer, "%.2f\t\n", millis(stats.Max))
+	}
+	return writer.Flush()
+}
+
+// writeDistribution writes the number of queries with durations up to
+// 1, 2, 5, 10, 20, 50... ms with a bar chart of the counts
+func (report *Report) writeDistribution(w io.Writer) error {
+	const maxBarWidth = 50
+
+	var bounds []float64
+	var counts []int64
+	var maxCount int64
+	for _, bin := range report.Histogram {
+		if len(bounds) == 0 || bin.Ms > bounds[len(bounds)-1] {
+			bound := distributionBound(bin.Ms)
+			bounds = append(bounds, bound)
+			counts = append(counts, 0)
+		}
+		counts[len(counts)-1] += bin.Count
+		if counts[len(counts)-1] > maxCount {
+			maxCount = counts[len(counts)-1]
+		}
+	}
+
+	fmt.Fprintf(w, "\nLatency distribution:\n")
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, bound := range bounds {
+		bar := strings.Repeat("#", int(math.Ceil(float64(counts[i])/float64(maxCount)*maxBarWidth)))
+		fmt.Fprintf(writer, "<= %vms\t%d\t%s\n", bound, counts[i], bar)
+	}
+	return writer.Flush()
+}
+
+// formatBytes formats a number of bytes with a unit, like 1.5 MB
+func formatBytes(bytes float64) string {
+	units := []string{"bytes", "kB", "MB", "GB"}
+	unit := 0
+	for bytes >= 1000 && unit < len(units)-1 {
+		bytes /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f bytes", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
+
+// distributionBound returns the smallest number in the series ... 0.1, 0.2, 0.5, 1, 2, 5, 10, 20, 50 ...
+// that's greater than or equal to ms
+func distributionBound(ms float64) float64 {
+	if ms <= 0 {
+		return 0
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10(ms)))
+	for _, step := range []float64{1, 2, 5, 10} {
+		// Round to avoid floating point noise like 0.30000000000000004
+		bound := math.Round(step*magnitude*1e6) / 1e6
+		if ms <= bound {
+			return bound
+		}
+	}
+	return 10 * magnitude
+}
+
+// writeQueryTable writes a table of the summary statistics for each query template (variant)
+func (report *Report) writeQueryTable(w io.Writer) error {
+	fmt.Fprintf(w, "\nPer query stats (ms):\n")
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(writer, "query\tcount\tfailed\ttimed out\tmin\tmedian\taverage\t")
+	for _, percentile := range report.Percentiles {
+		fmt.Fprintf(writer, "%s\t", percentileOrdinal(percentile))
+	}
+	fmt.Fprintln(writer, "max\tstddev\trows/query\tfirst row\tdrain\t")
+
+	for _, query := range report.ByQuery {
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t", query.Query, query.Succeeded, query.Failed, query.TimedOut)
+		stats := query.Summary
+		if stats == nil {
+			fmt.Fprintln(writer, strings.Repeat("-\t", 8+len(report.Percentiles)))
+			continue
+		}
+		fmt.Fprintf(writer, "%.2f\t%.2f\t%.2f\t", millis(stats.Min), millis(stats.Median), millis(stats.Average))
+		for _, p := range stats.Percentiles {
+			fmt.Fprintf(writer, "%.2f\t", millis(p.Value))
+		}
+		fmt.Fprintf(writer, "%.2f\t%.2f\t%.1f\t%.2f\t%.2f\t\n", millis(stats.Max), stats.StdDev,
+			float64(query.Rows)/float64(query.Succeeded), query.AverageFirstRowMs, query.AverageDrainMs)
+	}
+	return writer.Flush()
+}
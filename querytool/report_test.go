@@ -0,0 +1,433 @@
+package querytool
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testReport() *Report {
+	options := &Options{
+		DBConnectionString: "postgres://postgres:password@db/homework?sslmode=disable",
+		NumWorkers:         2,
+		ConnMode:           PoolConns,
+		Driver:             PQDriver,
+		Protocol:           ExtendedProtocol,
+		Percentiles:        []float64{50, 95},
+	}
+	allStats := []QueryStats{
+		{WorkerId: 1, Query: "a", Host: "host_1", Duration: 10 * time.Millisecond, NumResultRows: 10, NumResultBytes: 400,
+			TimeToFirstRow: 8 * time.Millisecond, DrainTime: 2 * time.Millisecond},
+		{WorkerId: 2, Query: "b", Host: "host_2", Duration: 30 * time.Millisecond, NumResultRows: 60, NumResultBytes: 2400,
+			TimeToFirstRow: 10 * time.Millisecond, DrainTime: 20 * time.Millisecond},
+		{WorkerId: 1, Query: "a", Host: "host_1", Duration: 20 * time.Millisecond, NumResultRows: 20, NumResultBytes: 800,
+			TimeToFirstRow: 16 * time.Millisecond, DrainTime: 4 * time.Millisecond},
+		{WorkerId: 2, Query: "b", Host: "host_2", Err: &QueryError{Class: SQLError, Err: errors.New("syntax error")}},
+	}
+
+	results := NewResults()
+	for i := range allStats {
+		results.Add(&allStats[i])
+	}
+
+	report := NewReport(options, 40*time.Millisecond, results)
+	report.Timestamp = time.Date(2022, 2, 1, 12, 0, 0, 0, time.UTC)
+	return report
+}
+
+func TestNewReport(t *testing.T) {
+	report := testReport()
+
+	a := assert.New(t)
+	a.Equal(report.Target, "postgres://postgres:xxxxx@db/homework?sslmode=disable")
+	a.Equal(report.Queries, 4)
+	a.Equal(report.Succeeded, 3)
+	a.Equal(report.Failed, 1)
+	a.Equal(report.Errors, []ErrorCount{{Class: "sql", Count: 1, FirstError: "syntax error"}})
+	a.Equal(report.Speedup, 1.5)
+	a.Equal(report.Summary.Total, 60*time.Millisecond)
+	a.Equal(len(report.ByQuery), 2)
+	a.Equal(report.ByQuery[0].Query, "a")
+	a.Equal(report.ByQuery[0].Succeeded, 2)
+	a.Equal(report.ByQuery[1].Query, "b")
+	a.Equal(report.ByQuery[1].Failed, 1)
+}
+
+func TestReportCSV(t *testing.T) {
+	// The percentiles are within 0.1% of the values, because they're computed from a Histogram
+	expected := `timestamp,target,workers,conn_mode,driver,protocol,wall_time_ms,speedup,query,queries,succeeded,failed,timed_out,min_ms,max_ms,average_ms,median_ms,stddev_ms,total_ms,rows,bytes,average_first_row_ms,average_drain_ms,p50_ms,p95_ms
+2022-02-01T12:00:00Z,postgres://postgres:xxxxx@db/homework?sslmode=disable,2,pool,pq,extended,40,1.5,all,4,3,1,0,10,30,20,20.004863,8.16496580927726,60,90,3600,11.333333,8.666666,20.004863,30
+2022-02-01T12:00:00Z,postgres://postgres:xxxxx@db/homework?sslmode=disable,2,pool,pq,extended,40,1.5,a,2,2,0,0,10,20,15,15.001215,5,30,30,1200,12,3,15.001215,20
+2022-02-01T12:00:00Z,postgres://postgres:xxxxx@db/homework?sslmode=disable,2,pool,pq,extended,40,1.5,b,2,1,1,0,30,30,30,30,0,30,60,2400,10,20,30,30
+`
+	var output strings.Builder
+	err := testReport().Write(&output, CSVFormat)
+
+	assert.Nil(t, err)
+	assert.Equal(t, output.String(), expected)
+}
+
+func TestReportJSON(t *testing.T) {
+	var output strings.Builder
+	err := testReport().Write(&output, JSONFormat)
+
+	a := assert.New(t)
+	a.Nil(err)
+	a.Contains(output.String(), `"timestamp": "2022-02-01T12:00:00Z"`)
+	a.Contains(output.String(), `"wall_time_ms": 40`)
+	a.Contains(output.String(), `"median_ms": 20.004863`)
+	a.Contains(output.String(), `"histogram": [
+    {
+      "ms": 9.998335,
+      "count": 1
+    },`)
+	a.Contains(output.String(), `"p95": 30`)
+	a.Contains(output.String(), `"percentiles": [
+    50,
+    95
+  ]`)
+}
+
+func TestReportText(t *testing.T) {
+	var output strings.Builder
+	err := testReport().Write(&output, TextFormat)
+
+	a := assert.New(t)
+	a.Nil(err)
+	a.Contains(output.String(), "Executed 4 queries in 0.04 seconds\n")
+	a.Contains(output.String(), "50th percentile = 20.00ms\n95th percentile = 30.00ms\n")
+	a.Contains(output.String(), "\nReturned 90 rows (2250.0 rows/second) and 3.6 kB (90.0 kB/second), "+
+		"30.0 rows and 1.2 kB per query on average\n"+
+		"time to first row: median 10.00ms, average 11.33ms, max 16.00ms\n"+
+		"time to drain the rows: median 4.00ms, average 8.67ms, max 20.00ms (43.3% of the total query duration)\n")
+}
+
+func TestFormatBytes(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(formatBytes(0), "0 bytes")
+	a.Equal(formatBytes(999), "999 bytes")
+	a.Equal(formatBytes(1500), "1.5 kB")
+	a.Equal(formatBytes(2.5e9), "2.5 GB")
+	a.Equal(formatBytes(3e12), "3000.0 GB")
+}
+
+func TestReportDistribution(t *testing.T) {
+	expected := `
+Latency distribution:
+<= 10ms  1  #########################
+<= 20ms  1  #########################
+<= 50ms  2  ##################################################
+`
+	report := testReport()
+	report.Histogram = append(report.Histogram, HistogramBin{Ms: 45, Count: 1})
+
+	var output strings.Builder
+	err := report.writeDistribution(&output)
+
+	assert.Nil(t, err)
+	assert.Equal(t, output.String(), expected)
+}
+
+func TestDistributionBound(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(distributionBound(0.25), 0.5)
+	a.Equal(distributionBound(1), 1.0)
+	a.Equal(distributionBound(1.01), 2.0)
+	a.Equal(distributionBound(3), 5.0)
+	a.Equal(distributionBound(7.5), 10.0)
+	a.Equal(distributionBound(150), 200.0)
+}
+
+func TestPercentileOrdinal(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(percentileOrdinal(1), "1st")
+	a.Equal(percentileOrdinal(12), "12th")
+	a.Equal(percentileOrdinal(33), "33rd")
+	a.Equal(percentileOrdinal(99), "99th")
+	a.Equal(percentileOrdinal(99.9), "99.9th")
+}
+
+func TestRedactConnectionString(t *testing.T) {
+	tests := []struct {
+		connectionString string
+		expected         string
+	}{
+		{
+			connectionString: "postgres://postgres:password@db/homework?sslmode=disable",
+			expected:         "postgres://postgres:xxxxx@db/homework?sslmode=disable",
+		},
+		{
+			connectionString: "postgres://db/homework?password=secret",
+			expected:         "postgres://db/homework?password=xxxxx",
+		},
+		{
+			connectionString: "host=db password='se cret' dbname=homework",
+			expected:         "host=db password=xxxxx dbname=homework",
+		},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		a.Equal(redactConnectionString(test.connectionString), test.expected)
+	}
+}
+
+func TestReportOpenLoop(t *testing.T) {
+	options := &Options{NumWorkers: 2, Rate: 100, Arrivals: PoissonArrivals}
+	allStats := []QueryStats{
+		{WorkerId: 1, Query: "a", Duration: 10 * time.Millisecond},
+		{WorkerId: 2, Query: "a", Duration: 14 * time.Millisecond, Delay: 4 * time.Millisecond},
+	}
+	results := NewResults()
+	for i := range allStats {
+		results.Add(&allStats[i])
+	}
+
+	report := NewReport(options, 20*time.Millisecond, results)
+	a := assert.New(t)
+	a.Equal(report.AchievedQPS, 100.0)
+	a.Equal(report.MaxDelayMs, 4.0)
+	a.Equal(report.AverageDelayMs, 2.0)
+
+	var output strings.Builder
+	a.Nil(report.Write(&output, TextFormat))
+	a.Contains(output.String(), "Sent 100.0 queries/second with poisson arrivals (target 100), up to 4.00ms late (2.00ms on average)\n")
+}
+
+func TestReportNotRun(t *testing.T) {
+	// The benchmark failed before running any queries, e.g. the dedicated connections couldn't be opened
+	report := NewReport(&Options{NumWorkers: 2}, 0, NewResults())
+	a := assert.New(t)
+	a.Equal(report.AchievedQPS, 0.0)
+	a.Equal(report.RowsPerSec, 0.0)
+	a.Equal(report.BytesPerSec, 0.0)
+	for _, format := range []string{TextFormat, JSONFormat, CSVFormat} {
+		var output strings.Builder
+		a.Nil(report.Write(&output, format), format)
+	}
+}
+
+func TestReportTimestamp(t *testing.T) {
+	results := NewResults()
+	results.Start = time.Date(2022, 2, 1, 12, 0, 0, 0, time.Local)
+	// The report is built long after the run, e.g. after the slowest queries were explained
+	report := NewReport(&Options{NumWorkers: 1}, time.Second, results)
+	assert.Equal(t, report.Timestamp, results.Start.UTC())
+}
+
+func TestReportTimedOut(t *testing.T) {
+	results := NewResults()
+	results.Add(&QueryStats{WorkerId: 1, Query: "a", Duration: 10 * time.Millisecond})
+	results.Add(&QueryStats{WorkerId: 1, Query: "a", Duration: 50 * time.Millisecond,
+		Err: &QueryError{Class: TimeoutError, Err: errors.New("i/o timeout")}})
+
+	a := assert.New(t)
+	var output strings.Builder
+	a.Nil(NewReport(&Options{NumWorkers: 1, QueryTimeout: 50 * time.Millisecond}, time.Second, results).Write(&output, TextFormat))
+	a.Contains(output.String(), "\n1 queries timed out after 50ms (50.00% of queries)\n")
+	// Without -timeout it was the network that timed out
+	output.Reset()
+	a.Nil(NewReport(&Options{NumWorkers: 1}, time.Second, results).Write(&output, TextFormat))
+	a.Contains(output.String(), "\n1 queries timed out (50.00% of queries)\n")
+}
+
+func TestReportWarmup(t *testing.T) {
+	options := &Options{NumWorkers: 1, Percentiles: []float64{99}, WarmupQueries: 2}
+	results := NewResults()
+	results.Warmup = NewResults()
+	results.WarmupTime = 100 * time.Millisecond
+	allStats := []QueryStats{
+		{WorkerId: 1, Query: "a", Duration: 80 * time.Millisecond, Warmup: true},
+		{WorkerId: 1, Query: "a", Duration: 20 * time.Millisecond, Warmup: true},
+		{WorkerId: 1, Query: "a", Duration: 10 * time.Millisecond},
+		{WorkerId: 1, Query: "a", Duration: 10 * time.Millisecond},
+	}
+	for i := range allStats {
+		if allStats[i].Warmup {
+			results.Warmup.Add(&allStats[i])
+		} else {
+			results.Add(&allStats[i])
+		}
+	}
+
+	report := NewReport(options, 120*time.Millisecond, results)
+	a := assert.New(t)
+	a.Equal(report.WallTimeMs, 20.0)
+	a.Equal(report.Queries, 2)
+	a.Equal(report.Speedup, 1.0)
+	a.Equal(report.Summary.Max, 10*time.Millisecond)
+	a.Equal(report.Warmup.Queries, 2)
+	a.Equal(report.Warmup.WallTimeMs, 100.0)
+	a.Equal(report.Warmup.Summary.Max, 80*time.Millisecond)
+
+	var output strings.Builder
+	a.Nil(report.Write(&output, TextFormat))
+	a.Contains(output.String(), "Warmup: 2 queries in 0.10 seconds (0 failed, 0 timed out) are excluded from the stats below, "+
+		"their median was 50.00ms and max 80.00ms\nExecuted 2 queries in 0.02 seconds\n")
+}
+
+func TestReportPool(t *testing.T) {
+	report := testReport()
+	a := assert.New(t)
+	a.Nil(report.Pool)
+
+	report.Pool = newPoolReport(&PoolStats{
+		MaxOpenConnections: 2, OpenConnections: 2, WaitCount: 3, WaitDuration: 6 * time.Millisecond, MaxIdleClosed: 1,
+	})
+	a.Equal(report.Pool.WaitMs, 6.0)
+
+	var output strings.Builder
+	a.Nil(report.Write(&output, TextFormat))
+	a.Contains(output.String(), "\n2 database connections open at the end (max 2), "+
+		"1 closed because of the max idle connections and 0 because of their max lifetime\n"+
+		"queries waited for a free connection 3 times for 6.00ms in total, 10.0% of the total query duration\n")
+}
+
+func TestReportSlowest(t *testing.T) {
+	options := &Options{NumWorkers: 1, ExplainFilePath: "report.explain.json"}
+	results := NewResults()
+	results.Add(&QueryStats{WorkerId: 1, Query: "a", Host: "host_1", Duration: 30 * time.Millisecond})
+	results.Explained = []ExplainedQuery{
+		{Query: "a", Host: "host_1", DurationMs: 30, ExecutionMs: 12.5, PlanningMs: 1, Chunks: 3,
+			SharedHitBlocks: 100, SharedReadBlocks: 5, Plan: []byte(`[{}]`)},
+		{Query: "a", Host: "host_2", DurationMs: 20, Error: "canceling statement due to statement timeout"},
+	}
+
+	report := NewReport(options, 30*time.Millisecond, results)
+	a := assert.New(t)
+	a.Equal(report.ExplainFile, "report.explain.json")
+	a.Len(report.Slowest, 2)
+	// The plans are only in the explain file
+	a.Nil(report.Slowest[0].Plan)
+	a.NotNil(results.Explained[0].Plan)
+
+	var output strings.Builder
+	a.Nil(report.Write(&output, TextFormat))
+	a.Contains(output.String(), "\nSlowest queries, run again with EXPLAIN ANALYZE (plans in report.explain.json):\n"+
+		"  query    host     ms  explain ms  planning ms  chunks  buffers hit  buffers read\n"+
+		"      a  host_1  30.00       12.50         1.00       3          100             5\n"+
+		"      a  host_2  20.00  error: canceling statement due to statement timeout\n")
+}
+
+func TestReportVerification(t *testing.T) {
+	results := NewResults()
+	results.Add(&QueryStats{WorkerId: 1, Query: "a", Host: "host_1", Duration: 10 * time.Millisecond})
+	results.Verification = &Verification{
+		Checked: 12, Mismatched: 11, Unchecked: 2,
+		Mismatches: make([]Mismatch, maxMismatches),
+	}
+	results.Verification.Mismatches[0] = Mismatch{Query: "a", Host: "host_1", Reason: "golden file: expected 60 rows, got 59"}
+
+	report := NewReport(&Options{NumWorkers: 1}, 10*time.Millisecond, results)
+	a := assert.New(t)
+	a.Equal(report.Verification.Mismatched, 11)
+	a.Len(report.Verification.Mismatches, maxMismatches)
+
+	var output strings.Builder
+	a.Nil(report.Write(&output, TextFormat))
+	a.Contains(output.String(), "Verified the results of 12 queries, 11 were wrong "+
+		"(2 couldn't be checked, there were no expected results for them)\n"+
+		"  a for host host_1: golden file: expected 60 rows, got 59\n")
+	a.Contains(output.String(), "  and 1 more\n")
+	a.Nil(testReport().Verification)
+}
+
+func TestReportBreakdown(t *testing.T) {
+	options := &Options{NumWorkers: 2, Breakdown: true, TopHosts: 2}
+	results := NewResults()
+	for _, stats := range []QueryStats{
+		{WorkerId: 1, Query: "a", Host: "host_1", Duration: 10 * time.Millisecond},
+		{WorkerId: 2, Query: "a", Host: "host_2", Duration: 40 * time.Millisecond},
+		{WorkerId: 1, Query: "a", Host: "host_1", Duration: 10 * time.Millisecond},
+		{WorkerId: 2, Query: "a", Host: "host_3", Duration: 20 * time.Millisecond},
+		{WorkerId: 2, Query: "a", Host: "host_4", Err: &QueryError{Class: SQLError, Err: errors.New("syntax error")}},
+	} {
+		stats := stats
+		results.Add(&stats)
+	}
+
+	report := NewReport(options, 80*time.Millisecond, results)
+	a := assert.New(t)
+	// Only the successful queries are included
+	a.Len(report.ByHost, 3)
+	a.Equal(report.ByHost[0].Host, "host_1")
+	a.Equal(report.ByHost[0].Queries, int64(2))
+	a.Equal(report.ByHost[2].Host, "host_3")
+	a.Len(report.ByWorker, 2)
+	a.Equal(report.ByWorker[1].Worker, 2)
+	a.Equal(report.ByWorker[1].Queries, int64(2))
+	a.Equal(report.ByWorker[1].Summary.Max, 40*time.Millisecond)
+	a.Len(report.SlowestHosts, 2)
+	a.Equal(report.SlowestHosts[0].Host, "host_2")
+	a.Equal(report.SlowestHosts[1].Host, "host_3")
+
+	var output strings.Builder
+	a.Nil(report.Write(&output, TextFormat))
+	a.Contains(output.String(), "\nThe 2 slowest hosts by median (ms):\n"+
+		"    host  count    min  median    max  vs median\n"+
+		"  host_2      1  40.00   40.00  40.00      2.67x\n"+
+		"  host_3      1  20.00   20.00  20.00      1.33x\n")
+	a.Contains(output.String(), "\nPer worker stats (ms):\n"+
+		"  worker  count    min  median    max  vs median\n"+
+		"       1      2  10.00   10.00  10.00      0.67x\n")
+
+	// The breakdown is optional
+	a.Nil(NewReport(&Options{NumWorkers: 2}, 80*time.Millisecond, results).ByHost)
+}
+
+func TestReportIntervals(t *testing.T) {
+	results := NewResults()
+	results.Add(&QueryStats{WorkerId: 1, Query: "a", Duration: 10 * time.Millisecond})
+	histogram := NewHistogram()
+	histogram.Record(10 * time.Millisecond)
+	results.Intervals = []IntervalStats{
+		{Start: 0, End: 2 * time.Second, Queries: 1, Succeeded: 1, Histogram: histogram},
+		{Start: 2 * time.Second, End: 4 * time.Second, Queries: 2, Failed: 2, Histogram: NewHistogram()},
+	}
+
+	report := NewReport(&Options{NumWorkers: 1}, 4*time.Second, results)
+	a := assert.New(t)
+	a.Len(report.Intervals, 2)
+	a.Equal(report.Intervals[1].QPS, 1.0)
+	a.Nil(report.Intervals[1].Summary)
+
+	var output strings.Builder
+	a.Nil(report.Write(&output, TextFormat))
+	a.Contains(output.String(), "\nPer interval stats (ms):\n"+
+		"  end (s)  queries  queries/second  failed  timed out   50th   95th   99th    max\n"+
+		"      2.0        1             0.5       0          0  10.00  10.00  10.00  10.00\n"+
+		"      4.0        2             1.0       2          0      -      -      -      -\n")
+	a.Nil(testReport().Intervals)
+}
+
+func TestReportBaseline(t *testing.T) {
+	results := NewResults()
+	baseline := &Baseline{Path: "baseline.json", Histogram: NewHistogram(), QPS: 400}
+	start := time.Now()
+	for i := 0; i < 40; i++ {
+		baseline.Histogram.Record(10 * time.Millisecond)
+		results.Add(&QueryStats{WorkerId: 1, Query: "a", Start: start.Add(time.Duration(i) * 25 * time.Millisecond),
+			Duration: 20 * time.Millisecond})
+	}
+	results.Baseline = baseline
+
+	report := NewReport(&Options{NumWorkers: 1, RegressionThreshold: 10}, time.Second, results)
+	a := assert.New(t)
+	a.True(report.Baseline.Regressed)
+	a.Nil(testReport().Baseline)
+
+	var output strings.Builder
+	a.Nil(report.Write(&output, TextFormat))
+	a.True(strings.HasSuffix(output.String(), "\nCompared with the baseline baseline.json (regression threshold 10%):\n"+
+		"     metric  baseline  current   change\n"+
+		"  median_ms     10.00    20.00  +100.0%  REGRESSED\n"+
+		"     p95_ms     10.00    20.00  +100.0%  REGRESSED\n"+
+		"     p99_ms     10.00    20.00  +100.0%  REGRESSED\n"+
+		"        qps    400.00    40.20   -89.9%  REGRESSED\n"+
+		"The query durations are significantly slower than the baseline (Mann-Whitney U test p=3.26e-19, "+
+		"a query is slower than a baseline query 100.0% of the time)\n"), output.String())
+}
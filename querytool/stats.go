@@ -1,8 +1,7 @@
 package querytool
 
 import (
-	"fmt"
-	"math"
+	"container/heap"
 	"sort"
 	"time"
 )
@@ -13,6 +12,59 @@ type QueryStats struct {
 	NumResultRows int
 	Duration      time.Duration
 	Host          string
+	Query         string        // the name of the QueryTemplate
+	Args          []interface{} // the values of the QueryTemplate's params
+	Start         time.Time     // when the query started
+	Err           *QueryError   // set if the query failed
+	// NumResultBytes is the approximate size of the result values, see fetchStats
+	NumResultBytes int64
+	// TimeToFirstRow is how long until the first row was received (or the query completed,
+	// if there were no rows), and DrainTime is how long it took to fetch the rest of the rows.
+	// A query that returns a lot of rows can be limited by the bandwidth, rather than the planning
+	// and execution, which shows up as a long drain time. They don't include the Delay.
+	TimeToFirstRow time.Duration
+	DrainTime      time.Duration
+	// Delay is how long after its scheduled send time the query started, in the
+	// open-loop mode (see Options.Rate). It's included in the Duration.
+	Delay time.Duration
+	// Warmup is true if the query ran in the warmup phase, see Options.WarmupQueries
+	Warmup bool
+	// query is the Query that was run, so it can be run again with EXPLAIN
+	query *Query
+	// rows are the result rows, if they're being verified, see Query.fetchRows
+	rows [][]interface{}
+}
+
+// Outcome is the result of running a query
+type Outcome int
+
+const (
+	Succeeded Outcome = iota
+	Failed
+	TimedOut
+)
+
+func (outcome Outcome) String() string {
+	switch outcome {
+	case Failed:
+		return "failed"
+	case TimedOut:
+		return "timed_out"
+	default:
+		return "succeeded"
+	}
+}
+
+// Outcome returns whether the query succeeded, failed or timed out
+func (stats *QueryStats) Outcome() Outcome {
+	switch {
+	case stats.Err == nil:
+		return Succeeded
+	case stats.Err.Class == TimeoutError:
+		return TimedOut
+	default:
+		return Failed
+	}
 }
 
 // IsZero returns true if this QueryStats struct is zero initialized
@@ -20,141 +72,265 @@ func (stats *QueryStats) IsZero() bool {
 	return stats.WorkerId == 0 && stats.Duration == 0 && stats.Host == ""
 }
 
-// ByDuration implements sort.Interface for []QueryStats based on the Duration (ascending)
-type ByDuration []QueryStats
-
-func (a ByDuration) Len() int           { return len(a) }
-func (a ByDuration) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByDuration) Less(i, j int) bool { return a[i].Duration < a[j].Duration }
-
-// PrintSummaryStats prints the summary statistics for all the queries run
-func PrintSummaryStats(options *Options, totalDuration time.Duration, allStats []QueryStats) {
-	stats := calculateSummaryStats(allStats)
-
-	// I asked about the purpose of this program and who the users might be.
-	// I was told not to worry about it. So I'm very much guessing here what
-	// summary statistics might be interesting to the user.
-	//
-	// Since it's a benchmark program, I output some stats about
-	// how long it took, how many queries were executed, what
-	// parallel speedup was acheived by using the specified number of workers.
-	//
-	// Since the requirements specify a min, max, median, and average
-	// value, I add the 95th percentile and standard deviation as those
-	// may also be interesting to the user.
-
-	// Print how many queries we executed and the "walltime" elapsed
-	fmt.Printf("Executed %d queries in %.2f seconds\n", len(allStats), float64(totalDuration)/float64(time.Second))
-	fmt.Printf("Total execution time for all queries was %.2f seconds, using %d worker threads. Parallel speedup of %.1fx\n",
-		float64(stats.Total)/float64(time.Second), options.NumWorkers, float64(stats.Total)/float64(totalDuration))
-	fmt.Printf(`
-min query duration = %.2fms
-max query duration = %.2fms
-average = %.2fms
-median = %.2fms
-95th percentile = %.2fms
-standard deviation = %.2fms
-total query duration = %.2fms
-`,
-		float64(stats.Min)/float64(time.Millisecond),
-		float64(stats.Max)/float64(time.Millisecond),
-		float64(stats.Average)/float64(time.Millisecond),
-		float64(stats.Median)/float64(time.Millisecond),
-		float64(stats._95Percentile)/float64(time.Millisecond),
-		stats.StdDev,
-		float64(stats.Total)/float64(time.Millisecond),
-	)
+// Results aggregates the QueryStats of a benchmark run.
+// Rather than keeping every QueryStats, it records the durations of the successful
+// queries in a Histogram per worker and per query, so the memory used is bounded
+// no matter how many queries are run.
+type Results struct {
+	Queries   int
+	Succeeded int
+	Failed    int
+	TimedOut  int
+	// Rows and Bytes are the total rows and approximate bytes returned by the successful queries
+	Rows  int64
+	Bytes int64
+	// FirstRow and Drain are the TimeToFirstRow and DrainTime of the successful queries
+	FirstRow *Histogram
+	Drain    *Histogram
+	// TotalDelay and MaxDelay are the QueryStats.Delay of all the queries, in the open-loop mode
+	TotalDelay, MaxDelay time.Duration
+	// Warmup are the results of the queries in the warmup phase, which are
+	// excluded from these Results. It's nil if there was no warmup phase.
+	Warmup *Results
+	// WarmupTime is how long from the start of the benchmark until the last warmup query completed
+	WarmupTime time.Duration
+	// Start is when the benchmark started, after the connections were opened, see runBenchmark.
+	// It's zero if the Results weren't from a benchmark run.
+	Start time.Time
+	// FirstStart and LastEnd are when the first query started and the last query completed
+	FirstStart, LastEnd time.Time
+	// slowest keeps the slowest successful queries, see KeepSlowest
+	slowest slowestQueries
+	// Intervals are the stats for each interval of the run, including the warmup phase.
+	// They're empty unless Options.Interval is set.
+	Intervals []IntervalStats
+	// Baseline is the previous run to compare with, nil if there isn't one
+	Baseline *Baseline
+	// Explained are the slowest queries run again with EXPLAIN, see ExplainSlowest
+	Explained []ExplainedQuery
+	// Verification counts the results checked by the Verifier, including the warmup queries.
+	// It's nil if the results weren't verified.
+	Verification *Verification
+	// Pool are the connection pool stats for the whole benchmark, including the warmup.
+	// It's nil if the Results weren't from a benchmark run.
+	Pool *PoolStats
+	// errors counts the failed queries by ErrorClass
+	errors   map[ErrorClass]*ErrorCount
+	byWorker map[int]*Histogram
+	byHost   map[string]*Histogram
+	// byQuery is in order of first appearance. Since every worker runs the
+	// queries for a row in the same order, that's the order of the templates.
+	byQuery      []*QueryResults
+	queryResults map[string]*QueryResults
 }
 
-type SummaryStats struct {
-	Min, Max, Total, Median, Average, _95Percentile time.Duration
-	StdDev                                          float64
+// QueryResults are the Results for a single query template (variant)
+type QueryResults struct {
+	Query     string
+	Succeeded int
+	Failed    int
+	TimedOut  int
+	Histogram *Histogram
+	// Rows, Bytes, FirstRow and Drain are the totals for the successful queries, see Results
+	Rows            int64
+	Bytes           int64
+	FirstRow, Drain time.Duration
+}
+
+// NewResults returns empty Results
+func NewResults() *Results {
+	return &Results{
+		FirstRow:     NewHistogram(),
+		Drain:        NewHistogram(),
+		errors:       make(map[ErrorClass]*ErrorCount),
+		byWorker:     make(map[int]*Histogram),
+		byHost:       make(map[string]*Histogram),
+		queryResults: make(map[string]*QueryResults),
+	}
 }
 
-// calculateSummaryStats computes the summary statistics for all the queries.
-// We use a separate method because we want to write unit tests for it.
-func calculateSummaryStats(allStats []QueryStats) SummaryStats {
-	if len(allStats) == 0 {
-		// This is programmer error, not a runtime error, so we panic
-		panic("allStats cannot be empty")
+// Add records the stats of a query
+func (results *Results) Add(stats *QueryStats) {
+	query := results.queryResults[stats.Query]
+	if query == nil {
+		query = &QueryResults{Query: stats.Query, Histogram: NewHistogram()}
+		results.queryResults[stats.Query] = query
+		results.byQuery = append(results.byQuery, query)
 	}
 
-	// This is not ideal sorting an array of structs since it means a lot of copying.
-	// Sorting an array of pointers to structs also has its issues (cache misses, allocations.)
-	// We need this to compute percentile values like the median or 95th percentile.
-	sort.Sort(ByDuration(allStats))
-
-	// We can use Duration (int64) for median and average
-	// because we don't need fractional nanoseconds.
-	// Computer clocks are just not that accurate,
-	// and neither is our benchmark code. We're actually going
-	// to drop the nanoseconds and microseconds when we display it anyway.
-	var min, max, total, average, median, _95percentile time.Duration
-	min = allStats[0].Duration
-	max = allStats[len(allStats)-1].Duration
-
-	// We'll use Welford's algorithm for estimation.
-	// This algorithm is more numerically stable than most other algorithms
-	// for calculating the variance.
-	n := .0
-	mu := .0
-	sq := .0
-
-	for _, stats := range allStats {
-		total += stats.Duration
-
-		n++
-		x := float64(stats.Duration) / float64(time.Millisecond)
-		nextMu := mu + (x-mu)/n
-		sq += (x - mu) * (x - nextMu)
-		mu = nextMu
+	results.Queries++
+	if results.FirstStart.IsZero() || stats.Start.Before(results.FirstStart) {
+		results.FirstStart = stats.Start
+	}
+	// The Delay is before the Start, in the open-loop mode
+	if end := stats.Start.Add(stats.Duration - stats.Delay); end.After(results.LastEnd) {
+		results.LastEnd = end
 	}
-	stddev := math.Sqrt(sq / n)
-
-	// Compute the median and the average
-	mid := len(allStats) / 2
-
-	// There are multiple ways to compute the median (50th percentile).
-	// Since we also compute the 95th percentile we'll use
-	// the same algorithm for both. It shouldn't matter much
-	// and it's easy enough to change if we must.
-	median = computePercentile(allStats, 0.5)
-	_95percentile = computePercentile(allStats, 0.95)
-
-	median = allStats[mid].Duration
-	if mid*2 == len(allStats) {
-		// We have an even number of queries, to compute the median
-		// take the two middle values and divide by 2.
-		median = (median + allStats[mid-1].Duration) / 2
+	results.TotalDelay += stats.Delay
+	if stats.Delay > results.MaxDelay {
+		results.MaxDelay = stats.Delay
 	}
-	average = total / time.Duration(len(allStats))
-
-	return SummaryStats{
-		Min:           min,
-		Max:           max,
-		Total:         total,
-		Median:        median,
-		Average:       average,
-		_95Percentile: _95percentile,
-		StdDev:        stddev,
+	switch stats.Outcome() {
+	case Succeeded:
+		results.Succeeded++
+		query.Succeeded++
+		query.Histogram.Record(stats.Duration)
+		query.Rows += int64(stats.NumResultRows)
+		query.Bytes += stats.NumResultBytes
+		query.FirstRow += stats.TimeToFirstRow
+		query.Drain += stats.DrainTime
+		results.Rows += int64(stats.NumResultRows)
+		results.Bytes += stats.NumResultBytes
+		results.FirstRow.Record(stats.TimeToFirstRow)
+		results.Drain.Record(stats.DrainTime)
+
+		worker := results.byWorker[stats.WorkerId]
+		if worker == nil {
+			worker = NewHistogram()
+			results.byWorker[stats.WorkerId] = worker
+		}
+		worker.Record(stats.Duration)
+		host := results.byHost[stats.Host]
+		if host == nil {
+			host = NewHistogram()
+			results.byHost[stats.Host] = host
+		}
+		host.Record(stats.Duration)
+		results.slowest.add(stats)
+	case Failed:
+		results.Failed++
+		query.Failed++
+
+		count := results.errors[stats.Err.Class]
+		if count == nil {
+			count = &ErrorCount{Class: stats.Err.Class.String(), FirstError: stats.Err.Error()}
+			results.errors[stats.Err.Class] = count
+		}
+		count.Count++
+	case TimedOut:
+		results.TimedOut++
+		query.TimedOut++
 	}
 }
 
-func computePercentile(allStats []QueryStats, percentile float64) time.Duration {
-	index := float64(len(allStats)) * percentile
+// KeepSlowest keeps the n slowest successful queries added after this,
+// so they can be run again with EXPLAIN, see ExplainSlowest
+func (results *Results) KeepSlowest(n int) {
+	results.slowest.max = n
+}
+
+// Slowest returns the slowest successful queries kept, slowest first, see KeepSlowest
+func (results *Results) Slowest() []QueryStats {
+	slowest := append([]QueryStats{}, results.slowest.queries...)
+	sort.Slice(slowest, func(i, j int) bool { return slowest[i].Duration > slowest[j].Duration })
+	return slowest
+}
 
-	// If the index is a whole number, then the percentile value
-	// is the average of the value at the index and the value that follows
-	// Otherwise we round it up to the nearest whole number and
-	// the value is the value at that index.
+// Histogram returns the durations of all the successful queries,
+// by merging the histograms of the workers.
+func (results *Results) Histogram() *Histogram {
+	histogram := NewHistogram()
+	for _, worker := range results.byWorker {
+		histogram.Merge(worker)
+	}
+	return histogram
+}
 
-	roundedUp := math.Ceil(index)
-	value := allStats[int(roundedUp)-1].Duration
-	// I'm not 100% sure this shouldn't be abs(roundedUp-index) < epsilon
-	if roundedUp == index {
-		// Index was a whole number so take the average
-		value = (value + allStats[int(roundedUp)].Duration) / 2
+// ActiveQPS returns the throughput over the time the queries were running, from FirstStart to LastEnd.
+// Unlike the throughput over the wall time it can be computed from the raw results, see LoadBaseline.
+func (results *Results) ActiveQPS() float64 {
+	if !results.LastEnd.After(results.FirstStart) {
+		return 0
 	}
+	return float64(results.Queries) / results.LastEnd.Sub(results.FirstStart).Seconds()
+}
+
+// ByWorker returns the durations of the successful queries of each worker
+func (results *Results) ByWorker() map[int]*Histogram {
+	return results.byWorker
+}
 
-	return value
+// ByHost returns the durations of the successful queries for each host
+func (results *Results) ByHost() map[string]*Histogram {
+	return results.byHost
+}
+
+// ByQuery returns the results for each query template (variant) in the order they were run
+func (results *Results) ByQuery() []*QueryResults {
+	return results.byQuery
+}
+
+// ErrorCounts returns the number of failed queries by ErrorClass, with the first error of each class
+func (results *Results) ErrorCounts() []ErrorCount {
+	// Always return a slice, so it's an empty list in the JSON rather than null
+	errorCounts := []ErrorCount{}
+	for _, class := range errorClasses {
+		if count := results.errors[class]; count != nil {
+			errorCounts = append(errorCounts, *count)
+		}
+	}
+	return errorCounts
+}
+
+// slowestQueries is a min heap of the max slowest queries, so the fastest of them
+// can be replaced in O(log max) time when a slower query is added
+type slowestQueries struct {
+	max     int
+	queries []QueryStats
+}
+
+func (h *slowestQueries) Len() int           { return len(h.queries) }
+func (h *slowestQueries) Less(i, j int) bool { return h.queries[i].Duration < h.queries[j].Duration }
+func (h *slowestQueries) Swap(i, j int)      { h.queries[i], h.queries[j] = h.queries[j], h.queries[i] }
+func (h *slowestQueries) Push(x interface{}) { h.queries = append(h.queries, x.(QueryStats)) }
+func (h *slowestQueries) Pop() interface{} {
+	last := h.queries[len(h.queries)-1]
+	h.queries = h.queries[:len(h.queries)-1]
+	return last
+}
+
+// add keeps the query if it's one of the max slowest so far, without its result rows
+func (h *slowestQueries) add(stats *QueryStats) {
+	if h.max == 0 {
+		return
+	}
+	kept := *stats
+	// The rows are only needed to verify the results, don't keep them for the whole run
+	kept.rows = nil
+	switch {
+	case len(h.queries) < h.max:
+		heap.Push(h, kept)
+	case kept.Duration > h.queries[0].Duration:
+		h.queries[0] = kept
+		heap.Fix(h, 0)
+	}
+}
+
+// millis converts the duration to fractional milliseconds for display
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// SummaryStats are the latency statistics for a group of successful queries
+type SummaryStats struct {
+	Min, Max, Total, Median, Average time.Duration
+	StdDev                           float64
+	// Percentiles has the value of each percentile requested, in the same order
+	Percentiles []Percentile
+}
+
+// Percentile is the value of a percentile of the query durations
+type Percentile struct {
+	Percentile float64 // in the range (0, 100), e.g. 99.9
+	Value      time.Duration
+}
+
+// Percentile returns the value of the percentile, if it was calculated
+func (stats *SummaryStats) Percentile(percentile float64) (time.Duration, bool) {
+	for _, p := range stats.Percentiles {
+		if p.Percentile == percentile {
+			return p.Value, true
+		}
+	}
+	return 0, false
 }
@@ -1,6 +1,7 @@
 package querytool
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -9,9 +10,9 @@ import (
 
 func TestPercentiles(t *testing.T) {
 	data := []int{43, 54, 56, 61, 62, 66, 68, 69, 69, 70, 71, 72, 77, 78, 79, 85, 87, 88, 89, 93, 95, 96, 98, 99, 99}
-	stats := make([]QueryStats, len(data))
-	for i, num := range data {
-		stats[i] = QueryStats{Duration: time.Duration(num)}
+	histogram := NewHistogram()
+	for _, num := range data {
+		histogram.Record(time.Duration(num))
 	}
 
 	tests := []struct {
@@ -19,15 +20,15 @@ func TestPercentiles(t *testing.T) {
 		expected   int
 	}{
 		{
-			percentile: 0.9,
+			percentile: 90,
 			expected:   98,
 		},
 		{
-			percentile: 0.2,
+			percentile: 20,
 			expected:   64,
 		},
 		{
-			percentile: 0.5,
+			percentile: 50,
 			expected:   77,
 		},
 	}
@@ -35,25 +36,54 @@ func TestPercentiles(t *testing.T) {
 	a := assert.New(t)
 	for i, test := range tests {
 		t.Logf("test #%d", i+1)
-		value := computePercentile(stats, test.percentile)
-		a.Equal(int(value), test.expected)
+		// These values are small enough that the histogram is exact
+		summary := histogram.Summary([]float64{test.percentile})
+		a.Equal(int(summary.Percentiles[0].Value), test.expected)
 	}
 }
 
 func TestSummaryStats(t *testing.T) {
 	data := []int{56354, 34453, 896789, 54362, 425467, 87665, 123413, 356346, 986878, 131374, 97987, 85644}
-	stats := make([]QueryStats, len(data))
-	for i, num := range data {
-		stats[i] = QueryStats{Duration: time.Duration(num) * time.Millisecond}
+	histogram := NewHistogram()
+	for _, num := range data {
+		histogram.Record(time.Duration(num) * time.Millisecond)
 	}
 
 	a := assert.New(t)
-	summary := calculateSummaryStats(stats)
+	summary := histogram.Summary([]float64{95, 99.9})
 	a.Equal(int(summary.Min), 34453*int(time.Millisecond))
 	a.Equal(int(summary.Max), 986878*int(time.Millisecond))
 	a.Equal(int(summary.Total), 3336732*int(time.Millisecond))
-	a.Equal(int(summary._95Percentile), 986878*int(time.Millisecond))
+	a.Equal(summary.Percentiles, []Percentile{
+		{Percentile: 95, Value: 986878 * time.Millisecond},
+		{Percentile: 99.9, Value: 986878 * time.Millisecond},
+	})
+	p95, ok := summary.Percentile(95)
+	a.True(ok)
+	a.Equal(p95, 986878*time.Millisecond)
 	a.Equal(int(summary.Average), 278061*int(time.Millisecond))
-	a.Equal(int(summary.Median), 110700*int(time.Millisecond))
-	a.Equal(summary.StdDev, 319214.8839603713)
+	// The average of the two middle values, to within the 0.1% precision of the histogram
+	a.InEpsilon(int(summary.Median), 110700*int(time.Millisecond), 0.001)
+	a.InDelta(summary.StdDev, 319214.8839603713, 1e-6)
+}
+
+func TestSlowest(t *testing.T) {
+	results := NewResults()
+	results.KeepSlowest(3)
+	for _, ms := range []int{5, 30, 10, 1, 20, 40, 2} {
+		results.Add(&QueryStats{WorkerId: 1, Host: "host", Duration: time.Duration(ms) * time.Millisecond,
+			rows: [][]interface{}{{ms}}})
+	}
+	// Failed queries aren't kept
+	results.Add(&QueryStats{WorkerId: 1, Host: "host", Duration: time.Second, Err: &QueryError{Class: SQLError, Err: errors.New("syntax error")}})
+
+	var durations []time.Duration
+	a := assert.New(t)
+	for _, stats := range results.Slowest() {
+		durations = append(durations, stats.Duration)
+		// The rows are only kept until they're verified
+		a.Nil(stats.rows)
+	}
+	a.Equal(durations, []time.Duration{40 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond})
+	a.Empty(NewResults().Slowest())
 }
@@ -0,0 +1,203 @@
+package querytool
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// SweepLevel is the Results of running the benchmark with a number of workers
+// and a connection mode (see Options.ConnMode)
+type SweepLevel struct {
+	Workers  int
+	ConnMode string
+	WallTime time.Duration
+	Results  *Results
+}
+
+// Sweep runs the benchmark once for each number of workers in Options.Sweep,
+// to find where adding workers stops improving the throughput. If Options.ConnMode
+// is both, it runs each number of workers with the pool and then with dedicated
+// connections. Without Options.Sweep it uses Options.NumWorkers.
+// Every level runs the same queries, loaded once, and has its own warmup phase.
+// It stops early if a level is aborted, returning the levels completed so far
+// (including the aborted one) and the error, or if ctx is cancelled.
+func Sweep(ctx context.Context, options *Options) ([]SweepLevel, error) {
+	templates, tasks := loadBenchmark(ctx, options)
+
+	// The raw results of all the levels go in the same file,
+	// the start offsets are from the start of the sweep.
+	rawWriter := openRawWriter(options, templates, time.Now())
+	verifier := openVerifier(options)
+	// The metrics are for the whole sweep, the active workers show the level that's running
+	metrics, metricsServer := openMetrics(options)
+	defer closeMetricsServer(metricsServer)
+
+	sweep := options.Sweep
+	if len(sweep) == 0 {
+		sweep = []int{options.NumWorkers}
+	}
+	connModes := []string{options.ConnMode}
+	if options.ConnMode == BothConns {
+		connModes = []string{PoolConns, DedicatedConns}
+	}
+
+	var levels []SweepLevel
+	var runErr error
+outer:
+	for _, numWorkers := range sweep {
+		for _, connMode := range connModes {
+			if ctx.Err() != nil {
+				break outer
+			}
+			if options.Verbose {
+				fmt.Fprintf(os.Stderr, "running the benchmark with %d workers and %s connections\n", numWorkers, connMode)
+			}
+
+			levelOptions := *options
+			levelOptions.NumWorkers = numWorkers
+			levelOptions.ConnMode = connMode
+			tasks.Reset()
+			dbs, conns, err := openWorkerConns(ctx, &levelOptions)
+			if err != nil {
+				runErr = fmt.Errorf("with %d workers and %s connections: %w", numWorkers, connMode, err)
+				break outer
+			}
+			results, wallTime, err := runBenchmark(ctx, &levelOptions, tasks, dbs, rawWriter, verifier, nil, metrics, time.Now())
+			closeConns(conns)
+			levels = append(levels, SweepLevel{
+				Workers: numWorkers, ConnMode: connMode, WallTime: wallTime, Results: results,
+			})
+			if err != nil {
+				runErr = fmt.Errorf("with %d workers and %s connections: %w", numWorkers, connMode, err)
+				break outer
+			}
+		}
+	}
+
+	if err := closeRawWriter(rawWriter); err != nil && runErr == nil {
+		runErr = err
+	}
+	if err := closeVerifier(verifier); err != nil && runErr == nil {
+		runErr = err
+	}
+	return levels, runErr
+}
+
+// SweepReport has a Report for each level of a Sweep
+type SweepReport struct {
+	Levels []*Report `json:"levels"`
+}
+
+// PrintSweep prints the reports for the levels of a Sweep
+// in the format and to the file given by the options.
+func PrintSweep(options *Options, levels []SweepLevel) error {
+	report := NewSweepReport(options, levels)
+
+	output := os.Stdout
+	if options.OutputFilePath != "" && options.OutputFilePath != "-" {
+		var err error
+		output, err = os.Create(options.OutputFilePath)
+		if err != nil {
+			return fmt.Errorf("PrintSweep failed to create %s: %w", options.OutputFilePath, err)
+		}
+		defer output.Close()
+	}
+
+	return report.Write(output, options.OutputFormat)
+}
+
+// NewSweepReport computes the Report for each level of a Sweep
+func NewSweepReport(options *Options, levels []SweepLevel) *SweepReport {
+	report := &SweepReport{Levels: []*Report{}}
+	for _, level := range levels {
+		levelOptions := *options
+		levelOptions.NumWorkers = level.Workers
+		levelOptions.ConnMode = level.ConnMode
+		report.Levels = append(report.Levels, NewReport(&levelOptions, level.WallTime, level.Results))
+	}
+	return report
+}
+
+// Write writes the report to w in the given format (text, json or csv).
+// The CSV format has the same columns as a Report, with the row for all the queries of each level.
+func (report *SweepReport) Write(w io.Writer, format string) error {
+	switch format {
+	case JSONFormat:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case CSVFormat:
+		if len(report.Levels) == 0 {
+			return nil
+		}
+		writer := csv.NewWriter(w)
+		if err := writer.Write(csvHeaderWithPercentiles(report.Levels[0].Percentiles)); err != nil {
+			return err
+		}
+		for _, level := range report.Levels {
+			if err := level.writeCSVRows(writer, false); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case TextFormat, "":
+		return report.writeText(w)
+	default:
+		return fmt.Errorf("unknown output format %s", format)
+	}
+}
+
+// writeText writes a table with the throughput, speedup and latency of each level.
+// The efficiency is the speedup divided by the number of workers, it drops
+// as the workers start waiting on each other (or the database) rather than running queries.
+func (report *SweepReport) writeText(w io.Writer) error {
+	if len(report.Levels) == 0 {
+		_, err := fmt.Fprintln(w, "No levels of the sweep completed")
+		return err
+	}
+	percentiles := report.Levels[0].Percentiles
+	// When comparing connection modes there's a column for the mode
+	compareConnModes := false
+	for _, level := range report.Levels {
+		compareConnModes = compareConnModes || level.ConnMode != report.Levels[0].ConnMode
+	}
+
+	fmt.Fprintf(w, "Scalability (latencies in ms):\n")
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	if compareConnModes {
+		fmt.Fprint(writer, "connections\t")
+	}
+	fmt.Fprint(writer, "workers\tqueries\tfailed\ttimed out\tqueries/s\tspeedup\tefficiency\tmedian\t")
+	for _, percentile := range percentiles {
+		fmt.Fprintf(writer, "%s\t", percentileOrdinal(percentile))
+	}
+	fmt.Fprintln(writer, "max\t")
+
+	for _, level := range report.Levels {
+		if compareConnModes {
+			fmt.Fprintf(writer, "%s\t", level.ConnMode)
+		}
+		fmt.Fprintf(writer, "%d\t%d\t%d\t%d\t%.1f\t%.1fx\t%.0f%%\t",
+			level.Workers, level.Queries, level.Failed, level.TimedOut, level.AchievedQPS,
+			level.Speedup, 100*level.Speedup/float64(level.Workers))
+		stats := level.Summary
+		if stats == nil {
+			fmt.Fprintln(writer, strings.Repeat("-\t", 2+len(percentiles)))
+			continue
+		}
+		fmt.Fprintf(writer, "%.2f\t", millis(stats.Median))
+		for _, p := range stats.Percentiles {
+			fmt.Fprintf(writer, "%.2f\t", millis(p.Value))
+		}
+		fmt.Fprintf(writer, "%.2f\t\n", millis(stats.Max))
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,88 @@
+package querytool
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSweepReport() *SweepReport {
+	options := &Options{
+		DBConnectionString: "host=db",
+		Percentiles:        []float64{99},
+		ConnMode:           PoolConns,
+		Driver:             PQDriver,
+		Protocol:           ExtendedProtocol,
+	}
+	var levels []SweepLevel
+	for _, workers := range []int{1, 2, 4} {
+		results := NewResults()
+		for i := 0; i < 4; i++ {
+			// Each query takes as long as the number of workers in ms, and they run in parallel
+			results.Add(&QueryStats{WorkerId: i%workers + 1, Query: "a", Duration: time.Duration(workers) * time.Millisecond})
+		}
+		levels = append(levels, SweepLevel{Workers: workers, ConnMode: PoolConns, WallTime: 4 * time.Millisecond, Results: results})
+	}
+	// The last level didn't have any successful queries
+	levels = append(levels, SweepLevel{Workers: 8, ConnMode: PoolConns, WallTime: time.Millisecond, Results: NewResults()})
+
+	report := NewSweepReport(options, levels)
+	for _, level := range report.Levels {
+		level.Timestamp = time.Date(2022, 2, 1, 12, 0, 0, 0, time.UTC)
+	}
+	return report
+}
+
+func TestSweepReportText(t *testing.T) {
+	expected := `Scalability (latencies in ms):
+  workers  queries  failed  timed out  queries/s  speedup  efficiency  median  99th   max
+        1        4       0          0     1000.0     1.0x        100%    1.00  1.00  1.00
+        2        4       0          0     1000.0     2.0x        100%    2.00  2.00  2.00
+        4        4       0          0     1000.0     4.0x        100%    4.00  4.00  4.00
+        8        0       0          0        0.0     0.0x          0%       -     -     -
+`
+	var output strings.Builder
+	err := testSweepReport().Write(&output, TextFormat)
+
+	assert.Nil(t, err)
+	assert.Equal(t, output.String(), expected)
+}
+
+func TestSweepReportCSV(t *testing.T) {
+	expected := `timestamp,target,workers,conn_mode,driver,protocol,wall_time_ms,speedup,query,queries,succeeded,failed,timed_out,min_ms,max_ms,average_ms,median_ms,stddev_ms,total_ms,rows,bytes,average_first_row_ms,average_drain_ms,p99_ms
+2022-02-01T12:00:00Z,host=db,1,pool,pq,extended,4,1,all,4,4,0,0,1,1,1,1,0,4,0,0,0,0,1
+2022-02-01T12:00:00Z,host=db,2,pool,pq,extended,4,2,all,4,4,0,0,2,2,2,2,0,8,0,0,0,0,2
+2022-02-01T12:00:00Z,host=db,4,pool,pq,extended,4,4,all,4,4,0,0,4,4,4,4,0,16,0,0,0,0,4
+2022-02-01T12:00:00Z,host=db,8,pool,pq,extended,1,0,all,0,0,0,0,,,,,,,,,,,
+`
+	var output strings.Builder
+	err := testSweepReport().Write(&output, CSVFormat)
+
+	assert.Nil(t, err)
+	assert.Equal(t, output.String(), expected)
+}
+
+func TestSweepReportCompareConnModes(t *testing.T) {
+	expected := `Scalability (latencies in ms):
+  connections  workers  queries  failed  timed out  queries/s  speedup  efficiency  median  99th   max
+         pool        2        1       0          0      500.0     1.5x         75%    3.00  3.00  3.00
+    dedicated        2        1       0          0      500.0     1.0x         50%    2.00  2.00  2.00
+`
+	var levels []SweepLevel
+	for i, connMode := range []string{PoolConns, DedicatedConns} {
+		results := NewResults()
+		results.Add(&QueryStats{WorkerId: 1, Query: "a", Duration: time.Duration(3-i) * time.Millisecond})
+		levels = append(levels, SweepLevel{Workers: 2, ConnMode: connMode, WallTime: 2 * time.Millisecond, Results: results})
+	}
+	report := NewSweepReport(&Options{Percentiles: []float64{99}}, levels)
+
+	var output strings.Builder
+	err := report.Write(&output, TextFormat)
+
+	a := assert.New(t)
+	a.Nil(err)
+	a.Equal(report.Levels[1].ConnMode, DedicatedConns)
+	a.Equal(output.String(), expected)
+}
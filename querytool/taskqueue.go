@@ -6,9 +6,12 @@ import (
 
 // TaskQueue represents an immutable collection of QueryTask structs
 // which can be consumed one at a time by calling Get().
+// By default the tasks are consumed once, see Loop to go over them repeatedly.
 type TaskQueue struct {
 	tasks        []QueryTask
 	currentIndex uint64
+	// iterations is the number of passes over tasks, 0 for no limit
+	iterations uint64
 }
 
 // NewTaskQueue constructs a new TaskQueue from the slice of QueryTasks.
@@ -17,11 +20,28 @@ func NewTaskQueue(tasks []QueryTask) *TaskQueue {
 	return &TaskQueue{
 		tasks:        tasks,
 		currentIndex: 0,
+		iterations:   1,
 	}
 }
 
+// Loop makes the queue go over the tasks the given number of times,
+// or forever if iterations is 0. It returns the queue for convenience.
+// Safety: Loop must be called before the queue is shared with other goroutines.
+func (queue *TaskQueue) Loop(iterations int) *TaskQueue {
+	queue.iterations = uint64(iterations)
+	return queue
+}
+
+// Reset makes all the tasks available again, so the same queries can be run again.
+// Safety: Reset must not be called while other goroutines are calling Get.
+func (queue *TaskQueue) Reset() {
+	atomic.StoreUint64(&queue.currentIndex, 0)
+}
+
 // Get returns the next available QueryTask in the queue.
-// Returns nil if all tasks have been consumed.
+// Returns nil if all tasks have been consumed the configured number of times.
+// When looping, the same task may be returned to more than one goroutine at a
+// time, if a pass over the queue finishes before the previous one does.
 // Safety: Get is safe to call from concurrent goroutines
 func (queue *TaskQueue) Get() *QueryTask {
 	// Get the next index into the tasks slice atomically.
@@ -35,14 +55,26 @@ func (queue *TaskQueue) Get() *QueryTask {
 	// Plus it lets me show off a little.
 	i := atomic.AddUint64(&queue.currentIndex, 1) - 1
 
-	if i < uint64(len(queue.tasks)) {
-		return &queue.tasks[i]
+	// A uint64 won't overflow in any realistic benchmark, even when looping forever.
+	n := uint64(len(queue.tasks))
+	if n == 0 || (queue.iterations != 0 && i >= n*queue.iterations) {
+		return nil
 	}
 
-	return nil
+	return &queue.tasks[i%n]
 }
 
-// Len returns the total number of tasks in the queue (consumed or not.)
+// Len returns the total number of tasks in the queue (consumed or not), for one pass.
 func (queue *TaskQueue) Len() int {
 	return len(queue.tasks)
 }
+
+// TotalQueries returns the number of queries in all the passes over the tasks,
+// or 0 if the queue loops forever.
+func (queue *TaskQueue) TotalQueries() int {
+	n := 0
+	for i := range queue.tasks {
+		n += len(queue.tasks[i].Queries)
+	}
+	return n * int(queue.iterations)
+}
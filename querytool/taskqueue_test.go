@@ -0,0 +1,52 @@
+package querytool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskQueue(t *testing.T) {
+	tasks := []QueryTask{
+		{Queries: []Query{{Host: "a"}}},
+		{Queries: []Query{{Host: "b"}}},
+		{Queries: []Query{{Host: "c"}}},
+	}
+
+	tests := []struct {
+		iterations int
+		numTasks   int
+	}{
+		{iterations: 1, numTasks: 3},
+		{iterations: 2, numTasks: 6},
+		{iterations: 5, numTasks: 15},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		queue := NewTaskQueue(tasks).Loop(test.iterations)
+		var hosts []string
+		for task := queue.Get(); task != nil; task = queue.Get() {
+			hosts = append(hosts, task.Queries[0].Host)
+		}
+		a.Equal(len(hosts), test.numTasks)
+		for j, host := range hosts {
+			a.Equal(host, tasks[j%len(tasks)].Queries[0].Host)
+		}
+		a.Nil(queue.Get())
+		a.Equal(queue.Len(), len(tasks))
+		a.Equal(queue.TotalQueries(), test.numTasks)
+	}
+}
+
+func TestTaskQueueLoopForever(t *testing.T) {
+	a := assert.New(t)
+	queue := NewTaskQueue([]QueryTask{{}, {}}).Loop(0)
+	a.Equal(queue.TotalQueries(), 0)
+	for i := 0; i < 1000; i++ {
+		a.NotNil(queue.Get())
+	}
+
+	a.Nil(NewTaskQueue(nil).Loop(0).Get())
+}
@@ -1,30 +1,29 @@
 package querytool
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
-)
 
-// There's a question whether this time interval should be
-// inclusive [start, end] or open-ended [start, end)
-// It's also a bit weird to display minute time intervals
-// but with start and end times that include seconds.
-// I think this query is most true to the requirements.
-const cpuStatsQuery = `
-	SELECT time_bucket('1 minute', u.ts) as one_min, min(u.usage), max(u.usage)
-	FROM cpu_usage u
-	WHERE u.host = $1
-	AND u.ts BETWEEN $2 AND $3
-	GROUP BY one_min
-	ORDER BY one_min DESC`
+	"github.com/lib/pq"
+)
 
+// QueryTask is a group of queries that are run sequentially by one worker
 type QueryTask struct {
-	Queries []CPUQuery
+	Queries []Query
 }
 
-type CPUQuery struct {
-	Host  string
-	Start time.Time
-	End   time.Time
+// Query is a QueryTemplate bound to one row of parameters from the CSV input
+type Query struct {
+	Template *QueryTemplate
+	Host     string
+	Args     []interface{}
+	// inlinedSQL is the SQL with the Args inlined, for the simple protocol
+	inlinedSQL string
+	// fetchRows keeps the result rows in the QueryStats, rather than discarding them, to verify them
+	fetchRows bool
 }
 
 // ByNumberOfQueries implements sort.Interface for []QueryTask based on the number of queries (descending)
@@ -34,7 +33,8 @@ func (a ByNumberOfQueries) Len() int           { return len(a) }
 func (a ByNumberOfQueries) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByNumberOfQueries) Less(i, j int) bool { return len(a[i].Queries) > len(a[j].Queries) }
 
-func (query *CPUQuery) Run() (QueryStats, error) {
+// Run runs the query on db, which is the pool or a dedicated connection
+func (query *Query) Run(ctx context.Context, db queryer) (QueryStats, error) {
 	// The OS and Go can both interrupt this routine, messing up the timing values
 	// I'm not going to do this here, but we can disable preemptive
 	// goroutine switching for this goroutine (the GC is disabled anyway.)
@@ -44,16 +44,80 @@ func (query *CPUQuery) Run() (QueryStats, error) {
 	// Subtracting two time values will use the monotonic clock value,
 	// which is what we want to get an accurate duration calculation.
 	start := time.Now()
-	stats := QueryStats{Host: query.Host}
+	stats := QueryStats{Host: query.Host, Query: query.Template.Name, Args: query.Args, Start: start, query: query}
 
-	numRows, err := query.executeQuery()
-	stats.NumResultRows = numRows
-	stats.Duration = time.Now().Sub(start)
+	var fetched fetchStats
+	var err error
+	if query.fetchRows {
+		stats.rows, fetched, err = query.fetchResultRows(ctx, db)
+	} else {
+		fetched, err = query.executeQuery(ctx, db)
+	}
+	end := time.Now()
+	stats.NumResultRows = fetched.rows
+	stats.NumResultBytes = fetched.bytes
+	stats.Duration = end.Sub(start)
+	if !fetched.firstRow.IsZero() {
+		stats.TimeToFirstRow = fetched.firstRow.Sub(start)
+		stats.DrainTime = end.Sub(fetched.firstRow)
+	}
 	return stats, err
 }
 
-func (query *CPUQuery) executeQuery() (int, error) {
-	return executeQueryAndDiscardResults(
-		cpuStatsQuery, query.Host, query.Start, query.End,
-	)
+func (query *Query) executeQuery(ctx context.Context, db queryer) (fetchStats, error) {
+	if query.inlinedSQL != "" {
+		return executeQueryAndDiscardResults(ctx, db, query.inlinedSQL)
+	}
+	return executeQueryAndDiscardResults(ctx, db, query.Template.SQL, query.Args...)
+}
+
+func (query *Query) fetchResultRows(ctx context.Context, db queryer) ([][]interface{}, fetchStats, error) {
+	if query.inlinedSQL != "" {
+		return db.queryRows(ctx, query.inlinedSQL)
+	}
+	return db.queryRows(ctx, query.Template.SQL, query.Args...)
+}
+
+// inlineArgs replaces the placeholders in the SQL with the Args as literals, so the query
+// can be run with the simple protocol, which doesn't support params. It's done before the
+// benchmark starts, so the time to do it isn't included in the durations.
+// Note a $1 inside a string literal or comment in the SQL is replaced too.
+func (query *Query) inlineArgs() error {
+	var err error
+	query.inlinedSQL = placeholderPattern.ReplaceAllStringFunc(query.Template.SQL, func(placeholder string) string {
+		i, _ := strconv.Atoi(placeholder[1:])
+		if i < 1 || i > len(query.Args) {
+			if err == nil {
+				err = fmt.Errorf("query %s has no param for placeholder %s", query.Template.Name, placeholder)
+			}
+			return placeholder
+		}
+		return quoteLiteral(query.Args[i-1])
+	})
+	return err
+}
+
+// quoteLiteral formats the value as a SQL literal
+func quoteLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		// The same format lib/pq sends timestamps in, the zone is ignored for a timestamp without time zone
+		return "'" + v.Format("2006-01-02 15:04:05.999999-07:00") + "'"
+	case int64:
+		return parenthesizeNegative(strconv.FormatInt(v, 10))
+	case float64:
+		return parenthesizeNegative(strconv.FormatFloat(v, 'g', -1, 64))
+	case string:
+		return pq.QuoteLiteral(v)
+	default:
+		return pq.QuoteLiteral(fmt.Sprint(v))
+	}
+}
+
+// parenthesizeNegative puts negative numbers in parentheses, otherwise "x -$1" would become the comment "x --1"
+func parenthesizeNegative(number string) string {
+	if strings.HasPrefix(number, "-") {
+		return "(" + number + ")"
+	}
+	return number
 }
@@ -0,0 +1,46 @@
+package querytool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInlineArgs(t *testing.T) {
+	template := &QueryTemplate{
+		Name: "test",
+		SQL:  "SELECT * FROM t WHERE host = $1 AND ts BETWEEN $2 AND $3 AND n > $4 AND x -$5 > 0 AND y = $10",
+	}
+	tests := []struct {
+		args     []interface{}
+		expected string
+		err      string
+	}{
+		{
+			args: []interface{}{
+				"host_1", time.Date(2017, 1, 1, 8, 59, 22, 0, time.UTC), time.Date(2017, 1, 1, 9, 59, 22, 500000000, time.UTC),
+				int64(5), -1.5, 6, 7, 8, 9, "it's",
+			},
+			expected: "SELECT * FROM t WHERE host = 'host_1' AND ts BETWEEN '2017-01-01 08:59:22+00:00' " +
+				"AND '2017-01-01 09:59:22.5+00:00' AND n > 5 AND x -(-1.5) > 0 AND y = 'it''s'",
+		},
+		{
+			args: []interface{}{"host_1"},
+			err:  "query test has no param for placeholder $2",
+		},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		query := Query{Template: template, Args: test.args}
+		err := query.inlineArgs()
+		if test.err != "" {
+			a.EqualError(err, test.err)
+		} else {
+			a.Nil(err)
+			a.Equal(query.inlinedSQL, test.expected)
+		}
+	}
+}
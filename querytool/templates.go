@@ -0,0 +1,366 @@
+package querytool
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// ParamType is the type of a query parameter.
+// It determines how the CSV value bound to the parameter is parsed.
+type ParamType int
+
+const (
+	TextParam ParamType = iota
+	TimestampParam
+	IntParam
+	FloatParam
+)
+
+var paramTypeNames = map[string]ParamType{
+	"text":      TextParam,
+	"timestamp": TimestampParam,
+	"int":       IntParam,
+	"float":     FloatParam,
+}
+
+func (t ParamType) String() string {
+	for name, paramType := range paramTypeNames {
+		if paramType == t {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// QueryParam declares a parameter of a QueryTemplate.
+// The parameter takes its value from the CSV column with the same name.
+type QueryParam struct {
+	Name string
+	Type ParamType
+}
+
+// QueryTemplate is a named, parameterized SQL query.
+// Params[i] is bound to the placeholder $i+1 in SQL.
+type QueryTemplate struct {
+	Name   string
+	SQL    string
+	Params []QueryParam
+
+	// builtin is true for the DefaultTemplates and their variants, and bucket and aggregates
+	// are the values a variant was made from by expandVariants, for computing its reference results
+	builtin            bool
+	bucket, aggregates string
+}
+
+// There's a question whether this time interval should be
+// inclusive [start, end] or open-ended [start, end)
+// It's also a bit weird to display minute time intervals
+// but with start and end times that include seconds.
+// I think this query is most true to the requirements.
+// The bucket width and aggregates are filled in by expandVariants.
+const cpuStatsQuery = `
+	SELECT time_bucket('{{.Bucket}}', u.ts) as bucket, {{.Aggregates}}
+	FROM cpu_usage u
+	WHERE u.host = $1
+	AND u.ts BETWEEN $2 AND $3
+	GROUP BY bucket
+	ORDER BY bucket DESC`
+
+// The default variant, which is the query given in the requirements
+const (
+	defaultBucket     = "1 minute"
+	defaultAggregates = "min(u.usage), max(u.usage)"
+)
+
+// DefaultTemplates returns the built-in templates used when no templates file is given.
+// The parameters match the columns of data/query_params.csv.
+func DefaultTemplates() []*QueryTemplate {
+	return []*QueryTemplate{
+		{
+			Name: "cpu_stats",
+			SQL:  cpuStatsQuery,
+			Params: []QueryParam{
+				{Name: hostColumn, Type: TextParam},
+				{Name: "start_time", Type: TimestampParam},
+				{Name: "end_time", Type: TimestampParam},
+			},
+			builtin: true,
+		},
+	}
+}
+
+// LoadTemplates loads the query templates from the file at path, or returns
+// the default templates if path is empty. If names is not empty, only the
+// templates with those names are returned, in the order given.
+func LoadTemplates(path string, names []string) ([]*QueryTemplate, error) {
+	templates := DefaultTemplates()
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("LoadTemplates failed to open %s: %w", path, err)
+		}
+		defer file.Close()
+
+		templates, err = parseTemplates(file)
+		if err != nil {
+			return nil, fmt.Errorf("LoadTemplates %s: %w", path, err)
+		}
+	}
+
+	if len(names) == 0 {
+		return templates, nil
+	}
+
+	selected := make([]*QueryTemplate, 0, len(names))
+	for _, name := range names {
+		template := findTemplate(templates, name)
+		if template == nil {
+			return nil, fmt.Errorf("LoadTemplates: no query template named %s", name)
+		}
+		selected = append(selected, template)
+	}
+	return selected, nil
+}
+
+func findTemplate(templates []*QueryTemplate, name string) *QueryTemplate {
+	for _, template := range templates {
+		if template.Name == name {
+			return template
+		}
+	}
+	return nil
+}
+
+const (
+	nameDirective   = "-- name:"
+	paramsDirective = "-- params:"
+)
+
+// parseTemplates parses a templates file. Each template starts with a name
+// directive followed by an optional params directive and the SQL text:
+//
+//	-- name: cpu_stats
+//	-- params: hostname, start_time timestamp, end_time timestamp
+//	SELECT ... WHERE u.host = $1 AND u.ts BETWEEN $2 AND $3
+//
+// A param is a CSV column name followed by an optional type
+// (text, timestamp, int, float), the default type is text.
+func parseTemplates(reader io.Reader) ([]*QueryTemplate, error) {
+	var templates []*QueryTemplate
+	var current *QueryTemplate
+	var sql strings.Builder
+
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		current.SQL = strings.TrimSpace(sql.String())
+		sql.Reset()
+		if err := current.validate(); err != nil {
+			return err
+		}
+		if findTemplate(templates, current.Name) != nil {
+			return fmt.Errorf("duplicate query template name %s", current.Name)
+		}
+		templates = append(templates, current)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		switch {
+		case strings.HasPrefix(trimmed, nameDirective):
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			current = &QueryTemplate{Name: strings.TrimSpace(trimmed[len(nameDirective):])}
+		case strings.HasPrefix(trimmed, paramsDirective):
+			if current == nil {
+				return nil, fmt.Errorf("line %d: params must follow a name", line)
+			}
+			params, err := parseParams(trimmed[len(paramsDirective):])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			current.Params = params
+		default:
+			if current == nil {
+				if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+					// Blank lines and comments before the first template are ignored
+					continue
+				}
+				return nil, fmt.Errorf("line %d: SQL must follow a name", line)
+			}
+			sql.WriteString(text)
+			sql.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("no query templates found")
+	}
+
+	return templates, nil
+}
+
+func parseParams(text string) ([]QueryParam, error) {
+	var params []QueryParam
+	for _, field := range strings.Split(text, ",") {
+		parts := strings.Fields(field)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, fmt.Errorf("malformed param %q, expected: column_name [type]", strings.TrimSpace(field))
+		}
+
+		param := QueryParam{Name: parts[0], Type: TextParam}
+		if len(parts) == 2 {
+			paramType, ok := paramTypeNames[strings.ToLower(parts[1])]
+			if !ok {
+				return nil, fmt.Errorf("unknown type %s for param %s", parts[1], parts[0])
+			}
+			param.Type = paramType
+		}
+		params = append(params, param)
+	}
+	return params, nil
+}
+
+var placeholderPattern = regexp.MustCompile(`\$(\d+)`)
+
+// validate checks the template is complete and the placeholders in the SQL match the params
+func (template *QueryTemplate) validate() error {
+	if template.Name == "" {
+		return fmt.Errorf("query template name cannot be empty")
+	}
+	if template.SQL == "" {
+		return fmt.Errorf("query template %s has no SQL", template.Name)
+	}
+
+	// This doesn't understand string literals or comments in the SQL,
+	// but that's good enough to catch most mistakes.
+	maxPlaceholder := 0
+	for _, match := range placeholderPattern.FindAllStringSubmatch(template.SQL, -1) {
+		n, _ := strconv.Atoi(match[1])
+		if n > maxPlaceholder {
+			maxPlaceholder = n
+		}
+	}
+	if maxPlaceholder != len(template.Params) {
+		return fmt.Errorf("query template %s declares %d params but uses %d placeholders",
+			template.Name, len(template.Params), maxPlaceholder)
+	}
+	return nil
+}
+
+// variant holds the values substituted into a template's SQL by expandVariants
+type variant struct {
+	Bucket     string
+	Aggregates string
+}
+
+// expandVariants returns a template for each combination of bucket width and
+// aggregates used by each of the templates. A template's SQL can refer to them
+// with {{.Bucket}} and {{.Aggregates}}, e.g. time_bucket('{{.Bucket}}', ts).
+// Only the SQL that contains one of them is parsed as a text/template, other SQL
+// is left as it is, so it can contain {{, e.g. in a JSON literal.
+// The variant templates are named after the template and the values that vary, like:
+// cpu_stats bucket=5 minutes aggregates=avg(u.usage)
+func expandVariants(templates []*QueryTemplate, buckets, aggregates []string) ([]*QueryTemplate, error) {
+	if len(buckets) == 0 {
+		buckets = []string{defaultBucket}
+	}
+	if len(aggregates) == 0 {
+		aggregates = []string{defaultAggregates}
+	}
+
+	var variants []*QueryTemplate
+	for _, queryTemplate := range templates {
+		if !strings.Contains(queryTemplate.SQL, "{{.Bucket}}") && !strings.Contains(queryTemplate.SQL, "{{.Aggregates}}") {
+			variants = append(variants, &QueryTemplate{
+				Name:    queryTemplate.Name,
+				SQL:     queryTemplate.SQL,
+				Params:  queryTemplate.Params,
+				builtin: queryTemplate.builtin,
+			})
+			continue
+		}
+
+		sqlTemplate, err := template.New(queryTemplate.Name).Option("missingkey=error").Parse(queryTemplate.SQL)
+		if err != nil {
+			return nil, fmt.Errorf("query template %s: %w", queryTemplate.Name, err)
+		}
+
+		render := func(v variant) (string, error) {
+			var sql strings.Builder
+			if err := sqlTemplate.Execute(&sql, v); err != nil {
+				return "", fmt.Errorf("query template %s: %w", queryTemplate.Name, err)
+			}
+			return sql.String(), nil
+		}
+
+		// Only sweep the values the template actually uses, otherwise we'd run the same SQL repeatedly.
+		// We find out by rendering the template with two different values.
+		templateBuckets := buckets[:1]
+		templateAggregates := aggregates[:1]
+		first, err := render(variant{Bucket: "a", Aggregates: "a"})
+		if err != nil {
+			return nil, err
+		}
+		other, _ := render(variant{Bucket: "b", Aggregates: "a"})
+		usesBucket := other != first
+		if usesBucket {
+			templateBuckets = buckets
+		}
+		other, _ = render(variant{Bucket: "a", Aggregates: "b"})
+		usesAggregates := other != first
+		if usesAggregates {
+			templateAggregates = aggregates
+		}
+
+		for _, bucket := range templateBuckets {
+			for _, aggregate := range templateAggregates {
+				sql, err := render(variant{Bucket: bucket, Aggregates: aggregate})
+				if err != nil {
+					return nil, err
+				}
+
+				name := queryTemplate.Name
+				if len(templateBuckets) > 1 {
+					name += " bucket=" + bucket
+				}
+				if len(templateAggregates) > 1 {
+					name += " aggregates=" + aggregate
+				}
+				variant := &QueryTemplate{
+					Name:    name,
+					SQL:     sql,
+					Params:  queryTemplate.Params,
+					builtin: queryTemplate.builtin,
+				}
+				if usesBucket {
+					variant.bucket = bucket
+				}
+				if usesAggregates {
+					variant.aggregates = aggregate
+				}
+				variants = append(variants, variant)
+			}
+		}
+	}
+
+	return variants, nil
+}
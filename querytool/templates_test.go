@@ -0,0 +1,163 @@
+package querytool
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTemplates(t *testing.T) {
+	input := `-- Queries for the dashboard
+-- name: cpu_stats
+-- params: hostname, start_time timestamp, end_time timestamp
+SELECT time_bucket('1 minute', u.ts) as one_min, min(u.usage), max(u.usage)
+FROM cpu_usage u
+WHERE u.host = $1 AND u.ts BETWEEN $2 AND $3
+GROUP BY one_min
+
+-- name: host_count
+SELECT count(DISTINCT host) FROM cpu_usage
+`
+	expected := []*QueryTemplate{
+		{
+			Name: "cpu_stats",
+			SQL: `SELECT time_bucket('1 minute', u.ts) as one_min, min(u.usage), max(u.usage)
+FROM cpu_usage u
+WHERE u.host = $1 AND u.ts BETWEEN $2 AND $3
+GROUP BY one_min`,
+			Params: []QueryParam{
+				{Name: "hostname", Type: TextParam},
+				{Name: "start_time", Type: TimestampParam},
+				{Name: "end_time", Type: TimestampParam},
+			},
+		},
+		{
+			Name: "host_count",
+			SQL:  "SELECT count(DISTINCT host) FROM cpu_usage",
+		},
+	}
+
+	templates, err := parseTemplates(strings.NewReader(input))
+
+	assert.Nil(t, err)
+	assert.Equal(t, templates, expected)
+}
+
+func TestParseTemplatesError(t *testing.T) {
+	tests := []struct {
+		input string
+		err   error
+	}{
+		// SQL before the first name
+		{
+			input: "SELECT 1",
+			err:   errors.New("line 1: SQL must follow a name"),
+		},
+		// Unknown param type
+		{
+			input: "-- name: q\n-- params: hostname varchar\nSELECT $1",
+			err:   errors.New("line 2: unknown type varchar for param hostname"),
+		},
+		// Too few params
+		{
+			input: "-- name: q\n-- params: hostname\nSELECT $1, $2",
+			err:   errors.New("query template q declares 1 params but uses 2 placeholders"),
+		},
+		// Duplicate names
+		{
+			input: "-- name: q\nSELECT 1\n-- name: q\nSELECT 2",
+			err:   errors.New("duplicate query template name q"),
+		},
+		// Empty
+		{
+			input: "-- nothing here\n",
+			err:   errors.New("no query templates found"),
+		},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+
+		templates, err := parseTemplates(strings.NewReader(test.input))
+		a.Nil(templates)
+		a.Equal(err, test.err)
+	}
+}
+
+func TestExpandVariants(t *testing.T) {
+	templates := []*QueryTemplate{
+		{
+			Name:   "stats",
+			SQL:    "SELECT time_bucket('{{.Bucket}}', ts) AS b, {{.Aggregates}} FROM cpu_usage WHERE host = $1 GROUP BY b",
+			Params: []QueryParam{{Name: "hostname"}},
+		},
+		{
+			Name: "count",
+			SQL:  "SELECT count(*) FROM cpu_usage",
+		},
+	}
+	expected := []*QueryTemplate{
+		{
+			Name:       "stats bucket=10 seconds aggregates=min(usage)",
+			SQL:        "SELECT time_bucket('10 seconds', ts) AS b, min(usage) FROM cpu_usage WHERE host = $1 GROUP BY b",
+			Params:     []QueryParam{{Name: "hostname"}},
+			bucket:     "10 seconds",
+			aggregates: "min(usage)",
+		},
+		{
+			Name:       "stats bucket=10 seconds aggregates=avg(usage), max(usage)",
+			SQL:        "SELECT time_bucket('10 seconds', ts) AS b, avg(usage), max(usage) FROM cpu_usage WHERE host = $1 GROUP BY b",
+			Params:     []QueryParam{{Name: "hostname"}},
+			bucket:     "10 seconds",
+			aggregates: "avg(usage), max(usage)",
+		},
+		{
+			Name:       "stats bucket=1 hour aggregates=min(usage)",
+			SQL:        "SELECT time_bucket('1 hour', ts) AS b, min(usage) FROM cpu_usage WHERE host = $1 GROUP BY b",
+			Params:     []QueryParam{{Name: "hostname"}},
+			bucket:     "1 hour",
+			aggregates: "min(usage)",
+		},
+		{
+			Name:       "stats bucket=1 hour aggregates=avg(usage), max(usage)",
+			SQL:        "SELECT time_bucket('1 hour', ts) AS b, avg(usage), max(usage) FROM cpu_usage WHERE host = $1 GROUP BY b",
+			Params:     []QueryParam{{Name: "hostname"}},
+			bucket:     "1 hour",
+			aggregates: "avg(usage), max(usage)",
+		},
+		// Doesn't use the bucket or aggregates, so it's only run once
+		{
+			Name: "count",
+			SQL:  "SELECT count(*) FROM cpu_usage",
+		},
+	}
+
+	variants, err := expandVariants(templates, []string{"10 seconds", "1 hour"}, []string{"min(usage)", "avg(usage), max(usage)"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, variants, expected)
+}
+
+func TestExpandVariantsDefault(t *testing.T) {
+	variants, err := expandVariants(DefaultTemplates(), nil, nil)
+
+	a := assert.New(t)
+	a.Nil(err)
+	a.Equal(len(variants), 1)
+	a.Equal(variants[0].Name, "cpu_stats")
+	a.Contains(variants[0].SQL, "time_bucket('1 minute', u.ts) as bucket, min(u.usage), max(u.usage)")
+}
+
+func TestExpandVariantsLiteral(t *testing.T) {
+	// The SQL isn't a text/template unless it uses the bucket or aggregates
+	templates := []*QueryTemplate{{Name: "json", SQL: `SELECT '{{"a": 1}}'::jsonb`}}
+	variants, err := expandVariants(templates, []string{"1 minute", "1 hour"}, nil)
+
+	a := assert.New(t)
+	a.Nil(err)
+	a.Equal(variants, templates)
+	a.NotSame(variants[0], templates[0])
+}
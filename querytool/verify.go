@@ -0,0 +1,273 @@
+package querytool
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Verifier checks the result rows of the queries, so a benchmark can't pass while
+// returning the wrong data, e.g. after upgrading TimescaleDB or changing the compression.
+// The expected rows come from a golden file saved by a previous run (see GoldenRecord),
+// or are computed from the CSV file the cpu_usage table was loaded from.
+type Verifier struct {
+	// golden are the expected rows by goldenKey, nil if there's no golden file
+	golden map[string][][]interface{}
+	// reference is the cpu_usage data, nil if there's no reference data
+	reference *referenceData
+	// save writes the rows of each query to a golden file, if it's not nil
+	save     io.WriteCloser
+	encoder  *json.Encoder
+	saved    map[string]bool
+	savePath string
+}
+
+// GoldenRecord is a line of a golden file, which is JSON Lines
+type GoldenRecord struct {
+	Query  string                 `json:"query"`
+	Params map[string]interface{} `json:"params"`
+	// Rows are the result rows, with the timestamps formatted as RFC 3339 in UTC
+	// and the numbers as floats, see resultValue
+	Rows [][]interface{} `json:"rows"`
+}
+
+// Verification counts the results of the queries checked by the Verifier
+type Verification struct {
+	Checked    int
+	Mismatched int
+	// Unchecked are the successful queries there were no expected results for
+	Unchecked int
+	// Mismatches are the first maxMismatches queries that returned the wrong results
+	Mismatches []Mismatch
+}
+
+// Mismatch is a query that returned the wrong results
+type Mismatch struct {
+	Query  string                 `json:"query"`
+	Host   string                 `json:"host"`
+	Params map[string]interface{} `json:"params"`
+	Reason string                 `json:"reason"`
+}
+
+// maxMismatches is the number of Mismatches kept, the rest are only counted
+const maxMismatches = 10
+
+// NewVerifier loads the expected results from the golden file and the reference
+// cpu_usage data, if the paths aren't empty. If savePath isn't empty it creates
+// a golden file there, for the results of this run.
+func NewVerifier(goldenPath, referencePath, savePath string) (*Verifier, error) {
+	verifier := &Verifier{}
+	if goldenPath != "" {
+		file, err := os.Open(goldenPath)
+		if err != nil {
+			return nil, fmt.Errorf("NewVerifier failed to open %s: %w", goldenPath, err)
+		}
+		defer file.Close()
+		verifier.golden, err = loadGolden(file)
+		if err != nil {
+			return nil, fmt.Errorf("NewVerifier %s: %w", goldenPath, err)
+		}
+	}
+	if referencePath != "" {
+		file, err := os.Open(referencePath)
+		if err != nil {
+			return nil, fmt.Errorf("NewVerifier failed to open %s: %w", referencePath, err)
+		}
+		defer file.Close()
+		verifier.reference, err = loadReferenceData(file)
+		if err != nil {
+			return nil, fmt.Errorf("NewVerifier %s: %w", referencePath, err)
+		}
+	}
+	if savePath != "" {
+		file, err := os.Create(savePath)
+		if err != nil {
+			return nil, fmt.Errorf("NewVerifier failed to create %s: %w", savePath, err)
+		}
+		verifier.saveTo(file, savePath)
+	}
+	return verifier, nil
+}
+
+// saveTo writes the results of the queries to w as a golden file
+func (verifier *Verifier) saveTo(w io.WriteCloser, path string) {
+	verifier.save = w
+	verifier.encoder = json.NewEncoder(w)
+	verifier.saved = make(map[string]bool)
+	verifier.savePath = path
+}
+
+// loadGolden reads a golden file, returning the rows by goldenKey
+func loadGolden(reader io.Reader) (map[string][][]interface{}, error) {
+	golden := make(map[string][][]interface{})
+	decoder := json.NewDecoder(reader)
+	for line := 1; ; line++ {
+		var record GoldenRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return golden, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", line, err)
+		}
+		key, err := goldenKey(record.Query, record.Params)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", line, err)
+		}
+		golden[key] = record.Rows
+	}
+}
+
+// goldenKey identifies the results of a query by the template (variant) name and the params
+func goldenKey(query string, params map[string]interface{}) (string, error) {
+	// The map keys are sorted, and a decoded param encodes the same as the original
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	return query + " " + string(encoded), nil
+}
+
+// Verify checks the result rows of a successful query against the expected rows,
+// and counts the outcome in verification. The rows are saved to the golden file, the
+// first time the query is run, if there is one. It only returns an error if saving fails.
+func (verifier *Verifier) Verify(stats *QueryStats, verification *Verification) error {
+	query := stats.query
+	params := formatParams(query.Template, query.Args)
+	key, err := goldenKey(query.Template.Name, params)
+	if err != nil {
+		return err
+	}
+
+	checked := false
+	reason := ""
+	if expected, ok := verifier.golden[key]; ok {
+		checked = true
+		if mismatch := compareRows(expected, stats.rows); mismatch != "" {
+			reason = "golden file: " + mismatch
+		}
+	}
+	if verifier.reference != nil {
+		if expected, ok := verifier.reference.results(query); ok {
+			checked = true
+			if mismatch := compareRows(expected, stats.rows); mismatch != "" && reason == "" {
+				reason = "reference data: " + mismatch
+			}
+		}
+	}
+
+	switch {
+	case !checked:
+		verification.Unchecked++
+	case reason != "":
+		verification.Checked++
+		verification.Mismatched++
+		if len(verification.Mismatches) < maxMismatches {
+			verification.Mismatches = append(verification.Mismatches, Mismatch{
+				Query: query.Template.Name, Host: query.Host, Params: params, Reason: reason,
+			})
+		}
+	default:
+		verification.Checked++
+	}
+
+	if verifier.save != nil && !verifier.saved[key] {
+		verifier.saved[key] = true
+		rows := stats.rows
+		if rows == nil {
+			// Write an empty array rather than null
+			rows = [][]interface{}{}
+		}
+		return verifier.encoder.Encode(&GoldenRecord{Query: query.Template.Name, Params: params, Rows: rows})
+	}
+	return nil
+}
+
+// Close closes the golden file being saved, if there is one
+func (verifier *Verifier) Close() error {
+	if verifier.save == nil {
+		return nil
+	}
+	if err := verifier.save.Close(); err != nil {
+		return fmt.Errorf("error saving %s: %w", verifier.savePath, err)
+	}
+	return nil
+}
+
+// resultValue converts a value returned by the database driver to a string, float64, bool or nil,
+// so the results can be compared regardless of the driver and saved as JSON.
+// Timestamps are formatted as RFC 3339 in UTC.
+func resultValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, string, float64, bool:
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return string(v)
+	case float32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int:
+		return float64(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// compareRows returns why the actual rows don't match the expected rows, or "" if they do
+func compareRows(expected, actual [][]interface{}) string {
+	if len(expected) != len(actual) {
+		return fmt.Sprintf("expected %d rows, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if len(expected[i]) != len(actual[i]) {
+			return fmt.Sprintf("row %d: expected %d columns, got %d", i+1, len(expected[i]), len(actual[i]))
+		}
+		for j := range expected[i] {
+			if !resultValuesEqual(expected[i][j], actual[i][j]) {
+				return fmt.Sprintf("row %d column %d: expected %v, got %v", i+1, j+1, expected[i][j], actual[i][j])
+			}
+		}
+	}
+	return ""
+}
+
+// resultValuesEqual compares two values converted by resultValue. Numbers are equal if they're
+// within a relative error of 1e-9, since aggregates like avg depend on the order the values
+// are added in. lib/pq returns numerics as strings, so they're compared as numbers too.
+func resultValuesEqual(expected, actual interface{}) bool {
+	e, eIsNumber := resultNumber(expected)
+	a, aIsNumber := resultNumber(actual)
+	if eIsNumber && aIsNumber && (isFloat(expected) || isFloat(actual)) {
+		const epsilon = 1e-9
+		return e == a || math.Abs(e-a) <= epsilon*math.Max(math.Abs(e), math.Abs(a))
+	}
+	return expected == actual
+}
+
+func isFloat(value interface{}) bool {
+	_, ok := value.(float64)
+	return ok
+}
+
+// resultNumber returns the value as a number, if it is one or it's a string of one
+func resultNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
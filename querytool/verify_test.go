@@ -0,0 +1,114 @@
+package querytool
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultValue(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{value: nil, expected: nil},
+		{value: "host_1", expected: "host_1"},
+		{value: []byte("1.50"), expected: "1.50"},
+		{value: int64(60), expected: 60.0},
+		{value: float32(0.5), expected: 0.5},
+		{value: time.Date(2017, 1, 1, 9, 0, 0, 0, time.FixedZone("EST", -5*3600)), expected: "2017-01-01T14:00:00Z"},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		a.Equal(resultValue(test.value), test.expected)
+	}
+}
+
+func TestCompareRows(t *testing.T) {
+	expected := [][]interface{}{{"2017-01-01T09:01:00Z", 12.5, 60.0}, {"2017-01-01T09:00:00Z", 10.0, 1.5}}
+	tests := []struct {
+		actual   [][]interface{}
+		mismatch string
+	}{
+		{actual: [][]interface{}{{"2017-01-01T09:01:00Z", 12.5, 60.0}, {"2017-01-01T09:00:00Z", 10.0, 1.5}}},
+		// Within the rounding error of adding the values in a different order
+		{actual: [][]interface{}{{"2017-01-01T09:01:00Z", 12.500000000001, 60.0}, {"2017-01-01T09:00:00Z", 10.0, 1.5}}},
+		// lib/pq returns numerics as strings
+		{actual: [][]interface{}{{"2017-01-01T09:01:00Z", "12.5", 60.0}, {"2017-01-01T09:00:00Z", 10.0, "1.50"}}},
+		{
+			actual:   [][]interface{}{{"2017-01-01T09:01:00Z", 12.5, 60.0}},
+			mismatch: "expected 2 rows, got 1",
+		},
+		{
+			actual:   [][]interface{}{{"2017-01-01T09:01:00Z", 12.5, 60.0}, {"2017-01-01T09:00:00Z", 10.0}},
+			mismatch: "row 2: expected 3 columns, got 2",
+		},
+		{
+			actual:   [][]interface{}{{"2017-01-01T09:01:00Z", 12.5, 60.0}, {"2017-01-01T09:00:00Z", 10.1, 1.5}},
+			mismatch: "row 2 column 2: expected 10, got 10.1",
+		},
+		{
+			actual:   [][]interface{}{{"2017-01-01T09:02:00Z", 12.5, 60.0}, {"2017-01-01T09:00:00Z", 10.0, 1.5}},
+			mismatch: "row 1 column 1: expected 2017-01-01T09:01:00Z, got 2017-01-01T09:02:00Z",
+		},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		a.Equal(compareRows(expected, test.actual), test.mismatch)
+	}
+}
+
+func TestVerifyGolden(t *testing.T) {
+	templates := DefaultTemplates()
+	query := func(host string, rows ...[]interface{}) *QueryStats {
+		args := []interface{}{
+			host, time.Date(2017, 1, 1, 8, 59, 22, 0, time.UTC), time.Date(2017, 1, 1, 9, 59, 22, 0, time.UTC),
+		}
+		return &QueryStats{query: &Query{Template: templates[0], Host: host, Args: args}, rows: rows}
+	}
+
+	// Save the results of a run to a golden file
+	var golden nopCloser
+	verifier := &Verifier{}
+	verifier.saveTo(&golden, "golden.jsonl")
+	a := assert.New(t)
+	verification := &Verification{}
+	a.Nil(verifier.Verify(query("host_1", []interface{}{"2017-01-01T09:59:00Z", 10.0, 20.0}), verification))
+	a.Nil(verifier.Verify(query("host_2"), verification))
+	// The same query run again isn't saved twice
+	a.Nil(verifier.Verify(query("host_1", []interface{}{"2017-01-01T09:59:00Z", 10.0, 20.0}), verification))
+	a.Nil(verifier.Close())
+	a.Equal(verification, &Verification{Unchecked: 3})
+	a.Equal(golden.String(),
+		`{"query":"cpu_stats","params":{"end_time":"2017-01-01 09:59:22","hostname":"host_1","start_time":"2017-01-01 08:59:22"},`+
+			`"rows":[["2017-01-01T09:59:00Z",10,20]]}`+"\n"+
+			`{"query":"cpu_stats","params":{"end_time":"2017-01-01 09:59:22","hostname":"host_2","start_time":"2017-01-01 08:59:22"},`+
+			`"rows":[]}`+"\n")
+
+	// Verify the results of another run against it
+	var err error
+	verifier = &Verifier{}
+	verifier.golden, err = loadGolden(strings.NewReader(golden.String()))
+	a.Nil(err)
+	verification = &Verification{}
+	a.Nil(verifier.Verify(query("host_1", []interface{}{"2017-01-01T09:59:00Z", 10.0, 20.0}), verification))
+	a.Nil(verifier.Verify(query("host_2", []interface{}{"2017-01-01T09:59:00Z", 10.0, 20.0}), verification))
+	a.Nil(verifier.Verify(query("host_3"), verification))
+	a.Equal(verification, &Verification{
+		Checked:    2,
+		Mismatched: 1,
+		Unchecked:  1,
+		Mismatches: []Mismatch{{
+			Query:  "cpu_stats",
+			Host:   "host_2",
+			Params: map[string]interface{}{"hostname": "host_2", "start_time": "2017-01-01 08:59:22", "end_time": "2017-01-01 09:59:22"},
+			Reason: "golden file: expected 0 rows, got 1",
+		}},
+	})
+}
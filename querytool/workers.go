@@ -1,83 +1,582 @@
 package querytool
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math/rand"
+	"net/http"
+	"os"
 	"sync/atomic"
 	"time"
 )
 
-func Run(options *Options) []QueryStats {
-	tasks, err := LoadTasks(options.InputFilePath)
+// Run runs the benchmark and returns the Results of every query executed, and the wall time
+// of the benchmark itself, which doesn't include loading the input or opening the pool.
+// If the benchmark was aborted because of the error policy (see Options.MaxErrors)
+// or writing the raw results failed, it also returns an error, the stats include
+// the queries completed before that.
+// Cancelling ctx stops the benchmark early, the queries in progress are cancelled
+// and Run waits for the workers to exit before returning the stats collected so far.
+// The queries in the warmup phase are excluded from the Results, see Results.Warmup.
+// If Options.Rate is set the queries are sent at that rate (open-loop), rather than
+// each worker running the next query as soon as the previous one completes (closed-loop.)
+// The benchmark ends after Options.Iterations passes over the input queries,
+// or when Options.Duration is up, whichever comes first.
+func Run(ctx context.Context, options *Options) (*Results, time.Duration, error) {
+	// Load the baseline first, so a bad path doesn't waste a whole benchmark
+	baseline := openBaseline(options)
+	templates, tasks := loadBenchmark(ctx, options)
+	dbs, conns, err := openWorkerConns(ctx, options)
+	if err != nil {
+		results := NewResults()
+		results.Baseline = baseline
+		return results, 0, err
+	}
+	defer closeConns(conns)
+
+	verifier := openVerifier(options)
+	metrics, metricsServer := openMetrics(options)
+	defer closeMetricsServer(metricsServer)
+	// The raw results and the intervals are timed from here, the same as the wall time
+	start := time.Now()
+	rawWriter := openRawWriter(options, templates, start)
+	intervals := openIntervalRecorder(options, start)
+	results, wallTime, runErr := runBenchmark(ctx, options, tasks, dbs, rawWriter, verifier, intervals, metrics, start)
+	results.Baseline = baseline
+	if err := closeRawWriter(rawWriter); err != nil && runErr == nil {
+		runErr = err
+	}
+	if err := closeIntervalRecorder(intervals); err != nil && runErr == nil {
+		runErr = err
+	}
+	if err := closeVerifier(verifier); err != nil && runErr == nil {
+		runErr = err
+	}
+	return results, wallTime, runErr
+}
+
+// loadBenchmark loads the query templates and the input queries and opens the connection pool,
+// exiting on errors since there's nothing to report if the benchmark can't start.
+func loadBenchmark(ctx context.Context, options *Options) ([]*QueryTemplate, *TaskQueue) {
+	templates, err := LoadTemplates(options.TemplatesFilePath, options.QueryNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	templates, err = expandVariants(templates, options.Buckets, options.Aggregates)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tasks, err := LoadTasks(options.InputFilePath, templates)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tasks.Loop(options.Iterations)
+	verify := options.VerifyFilePath != "" || options.VerifyReferencePath != "" || options.SaveGoldenPath != ""
+	for i := range tasks.tasks {
+		for j := range tasks.tasks[i].Queries {
+			query := &tasks.tasks[i].Queries[j]
+			query.fetchRows = verify
+			if options.Protocol == SimpleProtocol {
+				if err = query.inlineArgs(); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+
+	config := PoolConfig{
+		MaxOpenConns:    options.MaxOpenConns,
+		MaxIdleConns:    options.MaxIdleConns,
+		ConnMaxLifetime: options.ConnMaxLifetime,
+		Protocol:        options.Protocol,
+	}
+	// For a sweep it's the most workers at any level
+	config.NumWorkers = options.NumWorkers
+	for _, numWorkers := range options.Sweep {
+		if numWorkers > config.NumWorkers {
+			config.NumWorkers = numWorkers
+		}
+	}
+	if config.MaxIdleConns == 0 {
+		// Keep a connection for every worker
+		config.MaxIdleConns = config.NumWorkers
+	}
+	err = InitDB(options.Driver, options.DBConnectionString, options.QueryTimeout, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if options.PrewarmConns > 0 {
+		if err = PrewarmPool(ctx, options.PrewarmConns); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return templates, tasks
+}
+
+// openWorkerConns returns the db each worker runs its queries on: the shared pool, or with
+// DedicatedConns its own connection which it keeps for the whole run, so the durations don't
+// include the pool. The connections are opened before the benchmark starts, so opening them
+// isn't timed. The caller must close the connections with closeConns when the run is finished.
+func openWorkerConns(ctx context.Context, options *Options) ([]queryer, []dedicatedConn, error) {
+	dbs := make([]queryer, options.NumWorkers)
+	for i := range dbs {
+		dbs[i] = pool
+	}
+	if options.ConnMode != DedicatedConns {
+		return dbs, nil, nil
+	}
+	if options.MaxOpenConns > 0 && options.MaxOpenConns < options.NumWorkers {
+		return nil, nil, fmt.Errorf("dedicated connections for %d workers need -max-open-conns of at least %d",
+			options.NumWorkers, options.NumWorkers)
+	}
+	conns, err := openConns(ctx, options.NumWorkers)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, conn := range conns {
+		dbs[i] = conn
+	}
+	return dbs, conns, nil
+}
+
+// openRawWriter creates the raw results file if Options.RawFilePath is set, otherwise it returns nil
+func openRawWriter(options *Options, templates []*QueryTemplate, start time.Time) *RawWriter {
+	if options.RawFilePath == "" {
+		return nil
+	}
+	rawWriter, err := NewRawWriter(options.RawFilePath, templates, start)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return rawWriter
+}
+
+// closeRawWriter closes the rawWriter, if it's not nil
+func closeRawWriter(rawWriter *RawWriter) error {
+	if rawWriter == nil {
+		return nil
+	}
+	if err := rawWriter.Close(); err != nil {
+		return fmt.Errorf("error writing raw results: %w", err)
+	}
+	return nil
+}
+
+// openIntervalRecorder returns an intervalRecorder if Options.Interval is set, otherwise it returns nil.
+// The intervals are printed to the statusOutput, and written to Options.IntervalFilePath.
+func openIntervalRecorder(options *Options, start time.Time) *intervalRecorder {
+	if options.Interval <= 0 {
+		return nil
+	}
+	file, err := os.Create(options.IntervalFilePath)
+	if err != nil {
+		log.Fatalf("failed to create %s: %v", options.IntervalFilePath, err)
+	}
+	recorder, err := newIntervalRecorder(statusOutput(options), file, options.IntervalFilePath, start)
+	if err != nil {
+		log.Fatalf("error writing %s: %v", options.IntervalFilePath, err)
+	}
+	return recorder
+}
+
+// openProgress returns the progress of the benchmark if Options.Progress is set and Options.Verbose isn't,
+// since the verbose output has a line for every query. Otherwise it returns nil.
+func openProgress(options *Options, tasks *TaskQueue, start time.Time) *progress {
+	if !options.Progress || options.Verbose {
+		return nil
+	}
+	var duration time.Duration
+	if options.Duration > 0 {
+		duration = options.WarmupDuration + options.Duration
+	}
+	output := statusOutput(options)
+	return newProgress(output, isTerminal(output), tasks.TotalQueries(), duration, start)
+}
+
+// statusOutput is where the status lines are written during the run, stdout, or stderr if
+// the report is written to stdout as JSON or CSV, so the lines don't get mixed into it
+func statusOutput(options *Options) *os.File {
+	if (options.OutputFilePath == "" || options.OutputFilePath == "-") && options.OutputFormat != TextFormat {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// closeIntervalRecorder closes the intervals, if it's not nil
+func closeIntervalRecorder(intervals *intervalRecorder) error {
+	if intervals == nil {
+		return nil
+	}
+	return intervals.Close()
+}
+
+// openMetrics serves the Metrics if Options.MetricsAddr is set, otherwise it returns nil
+func openMetrics(options *Options) (*Metrics, *http.Server) {
+	if options.MetricsAddr == "" {
+		return nil, nil
+	}
+	metrics := NewMetrics()
+	server, err := ServeMetrics(options.MetricsAddr, metrics)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return metrics, server
+}
+
+// closeMetricsServer stops serving the metrics, if server isn't nil
+func closeMetricsServer(server *http.Server) {
+	if server != nil {
+		server.Close()
+	}
+}
+
+// openBaseline loads the Options.BaselinePath if it's set, otherwise it returns nil
+func openBaseline(options *Options) *Baseline {
+	if options.BaselinePath == "" {
+		return nil
+	}
+	baseline, err := LoadBaseline(options.BaselinePath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return baseline
+}
 
-	err = InitDB(options.DBConnectionString)
+// openVerifier returns a Verifier if Options.VerifyFilePath, VerifyReferencePath
+// or SaveGoldenPath is set, otherwise it returns nil
+func openVerifier(options *Options) *Verifier {
+	if options.VerifyFilePath == "" && options.VerifyReferencePath == "" && options.SaveGoldenPath == "" {
+		return nil
+	}
+	verifier, err := NewVerifier(options.VerifyFilePath, options.VerifyReferencePath, options.SaveGoldenPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return verifier
+}
 
+// closeVerifier closes the verifier, if it's not nil
+func closeVerifier(verifier *Verifier) error {
+	if verifier == nil {
+		return nil
+	}
+	return verifier.Close()
+}
+
+// runBenchmark runs the tasks with Options.NumWorkers workers, see Run.
+// The stats of every query are written to rawWriter, if it's not nil,
+// and the result rows of the successful queries are checked by verifier, if it's not nil.
+// If any of them didn't match the expected rows, it returns an error.
+// Every Options.Interval the stats of the queries completed in it are recorded by intervals, if it's not nil.
+// The stats of every query and the number of live workers are exposed by metrics, if it's not nil.
+// Each worker runs its queries on its db, see openWorkerConns. It also returns the wall time from start.
+func runBenchmark(ctx context.Context, options *Options, tasks *TaskQueue, dbs []queryer, rawWriter *RawWriter,
+	verifier *Verifier, intervals *intervalRecorder, metrics *Metrics, start time.Time) (*Results, time.Duration, error) {
 	results := make(chan QueryStats, tasks.Len())
 	// liveWorkers is a shared atomic counter decremented when a worker exits
 	// when all workers exit then we'll close the results channel and
 	// compute the summary statistics below.
 	liveWorkers := int32(options.NumWorkers)
+	// cancel tells the workers to stop running queries early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if options.Duration > 0 {
+		// When the time is up the queries in progress are cancelled, the same as for Ctrl-C.
+		// They're cut short by the deadline, so they're dropped rather than reported as timeouts.
+		// The duration doesn't include the warmup phase, if it's a fixed time.
+		var cancelTimer context.CancelFunc
+		ctx, cancelTimer = context.WithTimeout(ctx, options.WarmupDuration+options.Duration)
+		defer cancelTimer()
+	}
+
 	// Launch the workers
-	for i := 0; i < options.NumWorkers; i++ {
-		go runWorker(i+1, &liveWorkers, tasks, results)
+	poolStart := pool.stats()
+	if metrics != nil {
+		metrics.setLiveWorkers(&liveWorkers)
+		defer metrics.setLiveWorkers(nil)
+	}
+	if options.Rate > 0 {
+		scheduled := make(chan scheduledQuery)
+		go dispatchQueries(ctx, tasks, scheduled, options.Rate, options.Arrivals == PoissonArrivals)
+		for i := 0; i < options.NumWorkers; i++ {
+			go runOpenLoopWorker(ctx, i+1, dbs[i], &liveWorkers, scheduled, results, options.QueryTimeout)
+		}
+	} else {
+		for i := 0; i < options.NumWorkers; i++ {
+			go runWorker(ctx, i+1, dbs[i], &liveWorkers, tasks, results, options.QueryTimeout)
+		}
 	}
 
-	allStats := make([]QueryStats, 0, tasks.Len())
-	for stats := range results {
+	var runErr error
+	numErrors := 0
+	allResults := NewResults()
+	allResults.Start = start
+	allResults.KeepSlowest(options.ExplainSlowest)
+	if verifier != nil {
+		allResults.Verification = &Verification{}
+	}
+	if options.WarmupQueries > 0 || options.WarmupDuration > 0 {
+		allResults.Warmup = NewResults()
+	}
+	warmupEnd := start.Add(options.WarmupDuration)
+	var ticks, progressTicks <-chan time.Time
+	if intervals != nil {
+		ticker := time.NewTicker(options.Interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	progress := openProgress(options, tasks, start)
+	if progress != nil {
+		ticker := time.NewTicker(progress.interval())
+		defer ticker.Stop()
+		progressTicks = ticker.C
+		// Leave the terminal clean for the report
+		defer progress.clear()
+	}
+	for {
+		var stats QueryStats
+		select {
+		case now := <-ticks:
+			if progress != nil {
+				progress.clear()
+			}
+			if err := intervals.next(now); err != nil && runErr == nil {
+				runErr = err
+				cancel()
+			}
+			continue
+		case now := <-progressTicks:
+			progress.update(now)
+			continue
+		case stats = <-results:
+		}
 		if stats.IsZero() {
 			// All workers have exited, there will be no new stats
 			break
 		}
-		allStats = append(allStats, stats)
+
+		// The warmup phase lasts for the first WarmupQueries results, and includes every
+		// query started in the first WarmupDuration. The queries are still run the same
+		// way, and are subject to MaxErrors, but they're recorded separately, so that cold
+		// caches and new connections don't skew the stats.
+		if allResults.Warmup != nil &&
+			(allResults.Warmup.Queries < options.WarmupQueries || stats.Start.Before(warmupEnd)) {
+			stats.Warmup = true
+			allResults.Warmup.Add(&stats)
+			allResults.WarmupTime = time.Now().Sub(start)
+		} else {
+			allResults.Add(&stats)
+		}
+
+		if verifier != nil && stats.Outcome() == Succeeded {
+			if err := verifier.Verify(&stats, allResults.Verification); err != nil && runErr == nil {
+				runErr = fmt.Errorf("error saving the golden results: %w", err)
+				cancel()
+			}
+		}
+		if intervals != nil {
+			intervals.add(&stats)
+		}
+		if progress != nil {
+			progress.add(&stats)
+		}
+		if metrics != nil {
+			metrics.add(&stats)
+		}
+		if rawWriter != nil {
+			if err := rawWriter.Write(&stats); err != nil && runErr == nil {
+				// There's no point continuing the benchmark if we can't record the results
+				runErr = fmt.Errorf("error writing raw results: %w", err)
+				cancel()
+			}
+		}
+
+		switch stats.Outcome() {
+		case TimedOut:
+			// Timeouts are reported separately and don't count towards MaxErrors,
+			// the timeout is how the user limits the impact of slow queries.
+			if options.Verbose {
+				fmt.Fprintf(os.Stderr, "query %s for host %s timed out after %.2fms by worker %d\n",
+					stats.Query, stats.Host, float64(stats.Duration)/float64(time.Millisecond), stats.WorkerId)
+			}
+			continue
+		case Failed:
+			numErrors++
+			if options.Verbose {
+				fmt.Fprintf(os.Stderr, "query %s for host %s failed with %s error by worker %d: %v\n",
+					stats.Query, stats.Host, stats.Err.Class, stats.WorkerId, stats.Err)
+			}
+			if runErr == nil && options.MaxErrors > 0 && numErrors >= options.MaxErrors {
+				// Keep reading results until the workers exit
+				runErr = fmt.Errorf("aborted after %d errors, the last error was running query %s: %w",
+					numErrors, stats.Query, stats.Err)
+				cancel()
+			}
+			continue
+		}
+
 		if options.Verbose {
-			fmt.Printf("query for host %s returns %d results and executed in %.2fms by worker %d\n",
-				stats.Host, stats.NumResultRows, float64(stats.Duration)/float64(time.Millisecond), stats.WorkerId)
+			fmt.Fprintf(os.Stderr, "query %s for host %s returns %d results and executed in %.2fms by worker %d\n",
+				stats.Query, stats.Host, stats.NumResultRows, float64(stats.Duration)/float64(time.Millisecond), stats.WorkerId)
 		}
 	}
 
-	return allStats
+	allResults.Pool = poolStatsSince(poolStart)
+	if intervals != nil {
+		var err error
+		allResults.Intervals, err = intervals.finish(time.Now())
+		if err != nil && runErr == nil {
+			runErr = err
+		}
+	}
+	if verification := allResults.Verification; verification != nil && verification.Mismatched != 0 && runErr == nil {
+		runErr = fmt.Errorf("%d of %d queries verified returned the wrong results",
+			verification.Mismatched, verification.Checked)
+	}
+	return allResults, time.Now().Sub(start), runErr
 }
 
 // runWorker runs a worker goroutine that will process tasks
-// from the TaskQueue one at a time, sending the results to
+// from the TaskQueue one at a time, running the queries on db, sending the results to
 // the main goroutine via the results channel.
+// Failed queries are sent as QueryStats with Err set.
+// Queries taking longer than timeout (if not zero) are cancelled and reported as timeouts.
+// The worker exits early when ctx is cancelled.
 func runWorker(
-	id int, liveWorkers *int32,
-	tasks *TaskQueue, results chan QueryStats) {
+	ctx context.Context, id int, db queryer, liveWorkers *int32,
+	tasks *TaskQueue, results chan QueryStats, timeout time.Duration) {
+	defer workerExited(liveWorkers, results)
 	for {
 		task := tasks.Get()
 		if task == nil {
-			break
+			return
 		}
-		for _, query := range task.Queries {
-			stats, err := query.Run()
-			if err != nil {
-				// In a different context we'd want to report this error
-				// back to the main thread and maybe gracefully shutdown
-				// the workers before exiting, or something else.
-				// Here an error means the database is not available
-				// or set up correctly (we validated the tasks
-				// when loading them) , or that we have a bug.
-				// Either way just reporting the error and exiting is
-				// the right thing to do, and also the easy solution.
-
-				// If this leaves zombie connections in the PostgreSQL server
-				// we'll need to clean up the connections first.
-				// I don't think it will though.
-				log.Fatalf("error running query: %v", err)
+		for i := range task.Queries {
+			stats, ok := runQuery(ctx, db, &task.Queries[i], timeout)
+			if !ok {
+				return
 			}
 			stats.WorkerId = id
 			results <- stats
 		}
 	}
+}
+
+// scheduledQuery is a query the dispatcher wants sent at a specific time
+type scheduledQuery struct {
+	query    *Query
+	sendTime time.Time
+}
+
+// dispatchQueries sends the queries from the TaskQueue to the workers at the given rate
+// (queries per second), independent of how long they take to complete. The time between
+// queries is constant, or if poisson is true, exponentially distributed so that the arrivals
+// are a Poisson process, like independent users refreshing their dashboards.
+// It closes the scheduled channel when the tasks run out or ctx is cancelled.
+func dispatchQueries(ctx context.Context, tasks *TaskQueue, scheduled chan<- scheduledQuery, rate float64, poisson bool) {
+	defer close(scheduled)
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	interval := float64(time.Second) / rate
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	sendTime := time.Now()
+	for {
+		task := tasks.Get()
+		if task == nil {
+			return
+		}
+		for i := range task.Queries {
+			// If all the workers are busy, this falls behind schedule and the following
+			// queries are sent as soon as a worker is free. They're still measured from
+			// their scheduled time, so the time spent waiting counts towards the latency.
+			// That's what avoids coordinated omission, a slow server can't hide its
+			// slow responses by slowing down the rate of queries.
+			if wait := time.Until(sendTime); wait > 0 {
+				timer.Reset(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case scheduled <- scheduledQuery{query: &task.Queries[i], sendTime: sendTime}:
+			case <-ctx.Done():
+				return
+			}
+
+			if poisson {
+				sendTime = sendTime.Add(time.Duration(random.ExpFloat64() * interval))
+			} else {
+				sendTime = sendTime.Add(time.Duration(interval))
+			}
+		}
+	}
+}
+
+// runOpenLoopWorker runs a worker goroutine that runs the queries sent by dispatchQueries,
+// sending the results to the main goroutine via the results channel like runWorker.
+// The durations are measured from the scheduled send time, rather than from when
+// the query actually started, see QueryStats.Delay.
+func runOpenLoopWorker(
+	ctx context.Context, id int, db queryer, liveWorkers *int32,
+	scheduled <-chan scheduledQuery, results chan QueryStats, timeout time.Duration) {
+	defer workerExited(liveWorkers, results)
+	for next := range scheduled {
+		stats, ok := runQuery(ctx, db, next.query, timeout)
+		if !ok {
+			return
+		}
+		stats.Delay = stats.Start.Sub(next.sendTime)
+		stats.Duration += stats.Delay
+		stats.WorkerId = id
+		results <- stats
+	}
+}
+
+// runQuery runs the query on db, cancelling it if it takes longer than timeout (if not zero.)
+// Failed queries are returned as QueryStats with Err set.
+// It returns false if the query didn't complete because ctx was cancelled.
+func runQuery(ctx context.Context, db queryer, query *Query, timeout time.Duration) (QueryStats, bool) {
+	if ctx.Err() != nil {
+		return QueryStats{}, false
+	}
+
+	queryCtx, cancelQuery := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		queryCtx, cancelQuery = context.WithTimeout(ctx, timeout)
+	}
+	defer cancelQuery()
+	stats, err := query.Run(queryCtx, db)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The query was cancelled because the benchmark is stopping.
+			// It didn't complete, but it didn't fail either, so it's not reported.
+			return stats, false
+		}
+		// An error usually means the database is not available
+		// or set up correctly (we validated the tasks when loading them),
+		// but it could also be a bad query template or an overloaded server.
+		// The main goroutine decides whether to keep going, so it's reported
+		// rather than exiting here, which would lose the stats collected so far.
+		stats.Err = newQueryError(err, timeout)
+		if queryCtx.Err() == context.DeadlineExceeded {
+			// Depending on when the deadline hit, the driver may return
+			// a cancellation or network error, but it's a timeout.
+			stats.Err.Class = TimeoutError
+		}
+	}
+	return stats, true
+}
 
-	// This worker is finished and will exit now
+// workerExited is called when a worker is finished and will exit
+func workerExited(liveWorkers *int32, results chan QueryStats) {
 	if atomic.AddInt32(liveWorkers, -1) == 0 {
 		// This is the last worker to exit, close the results channel.
 		// This will unblock the main goroutine and signal
@@ -0,0 +1,295 @@
+package querytool
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatchQueries(t *testing.T) {
+	tasks := []QueryTask{
+		{Queries: []Query{{Host: "a"}, {Host: "a"}}},
+		{Queries: []Query{{Host: "b"}, {Host: "b"}}},
+	}
+
+	tests := []struct {
+		poisson bool
+	}{
+		{poisson: false},
+		{poisson: true},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		scheduled := make(chan scheduledQuery)
+		go dispatchQueries(context.Background(), NewTaskQueue(tasks).Loop(2), scheduled, 1000, test.poisson)
+
+		var sent []scheduledQuery
+		for next := range scheduled {
+			sent = append(sent, next)
+		}
+		a.Equal(len(sent), 8)
+		a.Equal(sent[0].query.Host, "a")
+		a.Equal(sent[2].query.Host, "b")
+		for j := 1; j < len(sent); j++ {
+			interval := sent[j].sendTime.Sub(sent[j-1].sendTime)
+			a.GreaterOrEqual(int64(interval), int64(0))
+			if !test.poisson {
+				a.Equal(interval, time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestDispatchQueriesCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	scheduled := make(chan scheduledQuery)
+	go dispatchQueries(ctx, NewTaskQueue([]QueryTask{{Queries: []Query{{}}}}).Loop(0), scheduled, 1, false)
+
+	// The first query is sent immediately, the next one is a second later
+	<-scheduled
+	cancel()
+	_, ok := <-scheduled
+	assert.False(t, ok)
+}
+
+// fakeBackend is a backend that runs queries without a database. The SQL says what a
+// query does: "fail" returns an error, "sleep" takes sleep to run, and "block" runs
+// until it's cancelled. Anything else succeeds immediately, returning a row.
+type fakeBackend struct {
+	sleep time.Duration
+}
+
+func (db *fakeBackend) queryAndDiscard(ctx context.Context, query string, args ...interface{}) (fetchStats, error) {
+	switch {
+	case strings.Contains(query, "fail"):
+		return fetchStats{}, errors.New("relation \"cpu_usage\" does not exist")
+	case strings.Contains(query, "sleep"):
+		select {
+		case <-time.After(db.sleep):
+		case <-ctx.Done():
+			return fetchStats{}, ctx.Err()
+		}
+	case strings.Contains(query, "block"):
+		<-ctx.Done()
+		return fetchStats{}, ctx.Err()
+	}
+	return fetchStats{rows: 1, firstRow: time.Now()}, nil
+}
+
+func (db *fakeBackend) queryRows(ctx context.Context, query string, args ...interface{}) ([][]interface{}, fetchStats, error) {
+	fetched, err := db.queryAndDiscard(ctx, query, args...)
+	if err != nil {
+		return nil, fetched, err
+	}
+	return [][]interface{}{{int64(1)}}, fetched, nil
+}
+
+func (db *fakeBackend) conn(ctx context.Context) (dedicatedConn, error) {
+	return nil, errors.New("the fake backend has no connections")
+}
+
+func (db *fakeBackend) stats() PoolStats {
+	return PoolStats{}
+}
+
+func (db *fakeBackend) queryValue(ctx context.Context, query string, args ...interface{}) ([]byte, error) {
+	return nil, errors.New("the fake backend can't return values")
+}
+
+// runFakeBenchmark runs a query for each of the sqls, in order, on the fakeBackend
+func runFakeBenchmark(ctx context.Context, options *Options, db *fakeBackend, sqls ...string) (*Results, time.Duration, error) {
+	saved := pool
+	pool = db
+	defer func() { pool = saved }()
+
+	tasks := make([]QueryTask, len(sqls))
+	for i, sql := range sqls {
+		tasks[i].Queries = []Query{{Template: &QueryTemplate{Name: sql, SQL: sql}, Host: "host_000001"}}
+	}
+	dbs := make([]queryer, options.NumWorkers)
+	for i := range dbs {
+		dbs[i] = db
+	}
+	return runBenchmark(ctx, options, NewTaskQueue(tasks), dbs, nil, nil, nil, nil, time.Now())
+}
+
+func TestRunBenchmarkMaxErrors(t *testing.T) {
+	tests := []struct {
+		options   Options
+		sqls      []string
+		succeeded int
+		failed    int
+		timedOut  int
+		err       string
+	}{
+		{
+			// Without a limit, the failed queries are reported and the benchmark keeps going
+			options:   Options{NumWorkers: 1},
+			sqls:      []string{"fail", "select", "fail", "select"},
+			succeeded: 2,
+			failed:    2,
+		},
+		{
+			options:   Options{NumWorkers: 1, MaxErrors: 3},
+			sqls:      []string{"fail", "select", "fail", "select"},
+			succeeded: 2,
+			failed:    2,
+		},
+		{
+			// The blocked query is cancelled by the abort, so it's not reported
+			options:   Options{NumWorkers: 1, MaxErrors: 2},
+			sqls:      []string{"fail", "select", "fail", "block", "select"},
+			succeeded: 1,
+			failed:    2,
+			err: "aborted after 2 errors, the last error was running query fail: " +
+				"relation \"cpu_usage\" does not exist",
+		},
+		{
+			// Timeouts don't count towards MaxErrors
+			options:   Options{NumWorkers: 1, MaxErrors: 1, QueryTimeout: time.Millisecond},
+			sqls:      []string{"block", "block", "select"},
+			succeeded: 1,
+			timedOut:  2,
+		},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		results, _, err := runFakeBenchmark(context.Background(), &test.options, &fakeBackend{}, test.sqls...)
+		if test.err == "" {
+			a.Nil(err)
+		} else {
+			a.EqualError(err, test.err)
+		}
+		a.Equal(results.Succeeded, test.succeeded)
+		a.Equal(results.Failed, test.failed)
+		a.Equal(results.TimedOut, test.timedOut)
+	}
+}
+
+func TestRunBenchmarkCancel(t *testing.T) {
+	tests := []struct {
+		options Options
+		// cancelAfter cancels the context passed to runBenchmark, like Ctrl-C
+		cancelAfter time.Duration
+		sqls        []string
+		succeeded   int
+		timedOut    int
+	}{
+		{
+			// The queries in progress when the time is up are dropped, not reported
+			options:   Options{NumWorkers: 2, Duration: 20 * time.Millisecond},
+			sqls:      []string{"select", "block", "block", "select"},
+			succeeded: 1,
+		},
+		{
+			// They're cut short by the deadline, so they're not timeouts either
+			options:   Options{NumWorkers: 2, Duration: 20 * time.Millisecond, QueryTimeout: time.Minute},
+			sqls:      []string{"select", "block", "block", "select"},
+			succeeded: 1,
+		},
+		{
+			options:     Options{NumWorkers: 2},
+			cancelAfter: 20 * time.Millisecond,
+			sqls:        []string{"select", "block", "block", "select"},
+			succeeded:   1,
+		},
+		{
+			// A query that hits its own timeout is reported
+			options:   Options{NumWorkers: 1, Duration: time.Minute, QueryTimeout: time.Millisecond},
+			sqls:      []string{"block", "select"},
+			succeeded: 1,
+			timedOut:  1,
+		},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.cancelAfter > 0 {
+			time.AfterFunc(test.cancelAfter, cancel)
+		}
+		results, wallTime, err := runFakeBenchmark(ctx, &test.options, &fakeBackend{}, test.sqls...)
+		cancel()
+		a.Nil(err)
+		a.Equal(results.Queries, test.succeeded+test.timedOut)
+		a.Equal(results.Succeeded, test.succeeded)
+		a.Equal(results.TimedOut, test.timedOut)
+		a.Less(int64(wallTime), int64(time.Second))
+	}
+}
+
+func TestRunBenchmarkWarmup(t *testing.T) {
+	tests := []struct {
+		options Options
+		sqls    []string
+		warmup  int
+		queries int
+	}{
+		{
+			options: Options{NumWorkers: 1},
+			sqls:    []string{"select", "fail", "select"},
+			warmup:  -1,
+			queries: 3,
+		},
+		{
+			// The warmup queries are still subject to MaxErrors, but recorded separately
+			options: Options{NumWorkers: 1, WarmupQueries: 2, MaxErrors: 2},
+			sqls:    []string{"fail", "select", "fail", "block"},
+			warmup:  2,
+			queries: 1,
+		},
+		{
+			// Each query takes 50ms, so 2 of them start in the first 75ms
+			options: Options{NumWorkers: 1, WarmupDuration: 75 * time.Millisecond},
+			sqls:    []string{"sleep", "sleep", "sleep", "sleep"},
+			warmup:  2,
+			queries: 2,
+		},
+		{
+			// The warmup lasts for whichever is longer
+			options: Options{NumWorkers: 1, WarmupQueries: 3, WarmupDuration: 75 * time.Millisecond},
+			sqls:    []string{"sleep", "sleep", "sleep", "sleep"},
+			warmup:  3,
+			queries: 1,
+		},
+		{
+			options: Options{NumWorkers: 1, WarmupQueries: 1, WarmupDuration: 75 * time.Millisecond},
+			sqls:    []string{"sleep", "sleep", "sleep", "sleep"},
+			warmup:  2,
+			queries: 2,
+		},
+	}
+
+	a := assert.New(t)
+	for i, test := range tests {
+		t.Logf("test #%d", i+1)
+		results, wallTime, err := runFakeBenchmark(context.Background(), &test.options,
+			&fakeBackend{sleep: 50 * time.Millisecond}, test.sqls...)
+		if test.options.MaxErrors > 0 {
+			// The failed warmup query counts, the failed query after the warmup is the last straw
+			a.EqualError(err, "aborted after 2 errors, the last error was running query fail: "+
+				"relation \"cpu_usage\" does not exist")
+		} else {
+			a.Nil(err)
+		}
+		a.Equal(results.Queries, test.queries)
+		if test.warmup < 0 {
+			a.Nil(results.Warmup)
+			a.Equal(results.WarmupTime, time.Duration(0))
+			continue
+		}
+		a.Equal(results.Warmup.Queries, test.warmup)
+		a.Greater(int64(results.WarmupTime), int64(0))
+		a.Less(int64(results.WarmupTime), int64(wallTime))
+		a.False(results.FirstStart.Before(results.Warmup.LastEnd))
+	}
+}